@@ -0,0 +1,118 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	StateClosed = iota
+	StateOpen
+	StateHalfOpen
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+type Config struct {
+	Failures int `toml:"failures"`
+	Cooldown int `toml:"cooldown"`
+}
+
+// opens after Failures consecutive failures, lets one probe through after Cooldown seconds
+// and closes again once the probe succeeds
+type Breaker struct {
+	sync.Mutex
+	config   *Config
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func New(c *Config) *Breaker {
+	if c.Failures <= 0 {
+		c.Failures = 5
+	}
+
+	if c.Cooldown <= 0 {
+		c.Cooldown = 10
+	}
+
+	return &Breaker{config: c}
+}
+
+func (b *Breaker) State() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.state
+}
+
+func (b *Breaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < time.Duration(b.config.Cooldown)*time.Second {
+			return false
+		}
+
+		b.state, b.probing = StateHalfOpen, true
+		return true
+	case StateHalfOpen:
+		if b.probing {
+			return false
+		}
+
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *Breaker) Success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.state, b.failures, b.probing = StateClosed, 0, false
+}
+
+func (b *Breaker) Failure() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if b.state == StateHalfOpen || b.failures >= b.config.Failures {
+		b.state, b.openedAt = StateOpen, time.Now()
+	}
+}
+
+// breakers by key, such as a target address or host
+type Group struct {
+	sync.Mutex
+	config   *Config
+	breakers map[string]*Breaker
+}
+
+func NewGroup(c *Config) *Group {
+	return &Group{config: c, breakers: make(map[string]*Breaker, 16)}
+}
+
+func (g *Group) Get(key string) *Breaker {
+	g.Lock()
+	defer g.Unlock()
+
+	b, ok := g.breakers[key]
+
+	if !ok {
+		b = New(g.config)
+		g.breakers[key] = b
+	}
+
+	return b
+}
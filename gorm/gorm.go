@@ -1,28 +1,65 @@
 package gorm
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
+	"github.com/opay-o2o/golib/grpc"
 	"github.com/opay-o2o/golib/logger"
+	"github.com/opay-o2o/golib/prometheus"
+	"math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+// drivers other than mysql must be registered by importing golib/gorm/postgres or golib/gorm/sqlite
+const (
+	DriverMysql    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSqlite   = "sqlite3"
+)
+
+const (
+	loggerKey        = "golib:logger"
+	drainTimeout     = 30 * time.Second
+	defaultSlowQuery = 200 * time.Millisecond
+)
+
+// SlowQuery is in ms, 0 means 200 and a negative value disables the slow query log
 type Config struct {
-	Host         string `toml:"host"`
-	Port         uint   `toml:"port"`
-	User         string `toml:"user"`
-	Password     string `toml:"password"`
-	Charset      string `toml:"charset"`
-	Database     string `toml:"database"`
-	Timeout      int    `toml:"timeout" json:"timeout"`
-	MaxOpenConns int    `toml:"max_open_conns" json:"max_open_conns"`
-	MaxIdleConns int    `toml:"max_idle_conns" json:"max_idle_conns"`
-	MaxConnTtl   int    `toml:"max_conn_ttl" json:"max_conn_ttl"`
-	Debug        bool   `toml:"debug"`
+	Driver       string  `toml:"driver" json:"driver"`
+	Host         string  `toml:"host"`
+	Port         uint    `toml:"port"`
+	User         string  `toml:"user"`
+	Password     string  `toml:"password"`
+	Charset      string  `toml:"charset"`
+	Database     string  `toml:"database"`
+	SslMode      string  `toml:"ssl_mode" json:"ssl_mode"`
+	Timeout      int     `toml:"timeout" json:"timeout"`
+	MaxOpenConns int     `toml:"max_open_conns" json:"max_open_conns"`
+	MaxIdleConns int     `toml:"max_idle_conns" json:"max_idle_conns"`
+	MaxConnTtl   int     `toml:"max_conn_ttl" json:"max_conn_ttl"`
+	Debug        bool    `toml:"debug"`
+	SlowQuery    int     `toml:"slow_query" json:"slow_query"`
+	SampleRate   float64 `toml:"sample_rate" json:"sample_rate"`
+	Redact       bool    `toml:"redact" json:"redact"`
+}
+
+func (c *Config) GetDriver() string {
+	if c.Driver == "" {
+		return DriverMysql
+	}
+
+	return c.Driver
+}
+
+// sqlite keeps an in-memory database per connection, so it must never be closed or shared
+func (c *Config) IsMemory() bool {
+	return c.GetDriver() == DriverSqlite && (c.Database == "" || c.Database == ":memory:")
 }
 
 func (c *Config) GetDsn() string {
@@ -30,12 +67,35 @@ func (c *Config) GetDsn() string {
 		c.Timeout = 3
 	}
 
-	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=%s&parseTime=True&loc=Local&timeout=%ds",
-		c.User, c.Password, c.Host, c.Port, c.Database, c.Charset, c.Timeout)
+	switch c.GetDriver() {
+	case DriverPostgres:
+		sslMode := c.SslMode
+
+		if sslMode == "" {
+			sslMode = "disable"
+		}
+
+		return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s connect_timeout=%d",
+			c.Host, c.Port, c.User, c.Password, c.Database, sslMode, c.Timeout)
+	case DriverSqlite:
+		if c.IsMemory() {
+			return ":memory:"
+		}
+
+		return fmt.Sprintf("file:%s?_busy_timeout=%d", c.Database, c.Timeout*1000)
+	default:
+		return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=%s&parseTime=True&loc=Local&timeout=%ds",
+			c.User, c.Password, c.Host, c.Port, c.Database, c.Charset, c.Timeout)
+	}
 }
 
 type Logger struct {
-	logger *logger.Logger
+	logger        *logger.Logger
+	debug         bool
+	redact        bool
+	sampleRate    float64
+	slowThreshold time.Duration
+	traceId       string
 }
 
 func (l *Logger) Print(values ...interface{}) {
@@ -48,10 +108,7 @@ func (l *Logger) Print(values ...interface{}) {
 
 		if values[0] == "sql" {
 			if len(values) > 5 {
-				sql := gorm.LogFormatter(values...)[3]
-				execTime := float64(values[2].(time.Duration).Nanoseconds()/1e4) / 100.0
-				rows := values[5].(int64)
-				l.logger.Debugf("query: <%s> | %.2fms | %d rows | %s", source, execTime, rows, sql)
+				l.printSql(source, values...)
 			}
 		} else {
 			l.logger.Debug(source, values[2:])
@@ -59,42 +116,277 @@ func (l *Logger) Print(values ...interface{}) {
 	}
 }
 
+func (l *Logger) printSql(source string, values ...interface{}) {
+	duration := values[2].(time.Duration)
+	slow := l.slowThreshold > 0 && duration >= l.slowThreshold
+	sampled := !slow && !l.debug && l.sampleRate > 0 && rand.Float64() < l.sampleRate
+
+	if !slow && !l.debug && !sampled {
+		return
+	}
+
+	var sql string
+
+	if l.redact {
+		sql = values[3].(string)
+	} else {
+		sql = gorm.LogFormatter(values...)[3].(string)
+	}
+
+	execTime := float64(duration.Nanoseconds()/1e4) / 100.0
+	rows := values[5].(int64)
+	trace := ""
+
+	if l.traceId != "" {
+		trace = " | trace: " + l.traceId
+	}
+
+	switch {
+	case slow:
+		l.logger.Warningf("slow query: <%s> | %.2fms | %d rows%s | %s", source, execTime, rows, trace, sql)
+	case l.debug:
+		l.logger.Debugf("query: <%s> | %.2fms | %d rows%s | %s", source, execTime, rows, trace, sql)
+	default:
+		l.logger.Infof("query: <%s> | %.2fms | %d rows%s | %s", source, execTime, rows, trace, sql)
+	}
+}
+
+func (l *Logger) WithTraceId(traceId string) *Logger {
+	clone := *l
+	clone.traceId = traceId
+	return &clone
+}
+
+func NewLogger(l *logger.Logger, c *Config) *Logger {
+	slowThreshold := defaultSlowQuery
+
+	if c.SlowQuery > 0 {
+		slowThreshold = time.Duration(c.SlowQuery) * time.Millisecond
+	} else if c.SlowQuery < 0 {
+		slowThreshold = 0
+	}
+
+	return &Logger{
+		logger:        l,
+		debug:         c.Debug,
+		redact:        c.Redact,
+		sampleRate:    c.SampleRate,
+		slowThreshold: slowThreshold,
+	}
+}
+
+// whether any query may be printed, the detailed mode of gorm walks the stack for the source of every query
+func (l *Logger) detailed() bool {
+	return l.debug || l.sampleRate > 0 || l.slowThreshold > 0
+}
+
+// bind the trace id carried by ctx to the query logs of the returned db
+func WithContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	traceId := grpc.GetCtxTraceId(ctx)
+
+	if traceId == "" {
+		return db
+	}
+
+	v, ok := db.Get(loggerKey)
+
+	if !ok {
+		return db
+	}
+
+	l, ok := v.(*Logger)
+
+	if !ok {
+		return db
+	}
+
+	traced := l.WithTraceId(traceId)
+	tx := db.Set(loggerKey, traced)
+	tx.SetLogger(traced)
+
+	return tx
+}
+
 type Pool struct {
 	locker  sync.RWMutex
 	clients map[string]*gorm.DB
 	logger  *logger.Logger
+	monitor *prometheus.Monitor
+}
+
+func (p *Pool) open(c *Config) (*gorm.DB, error) {
+	orm, err := gorm.Open(c.GetDriver(), c.GetDsn())
+
+	if err != nil {
+		return nil, err
+	}
+
+	db := orm.DB()
+
+	if c.IsMemory() {
+		db.SetMaxIdleConns(1)
+		db.SetMaxOpenConns(1)
+	} else {
+		if c.MaxIdleConns > 0 {
+			db.SetMaxIdleConns(c.MaxIdleConns)
+		}
+
+		if c.MaxOpenConns > 0 {
+			db.SetMaxOpenConns(c.MaxOpenConns)
+		}
+
+		if c.MaxConnTtl > 0 {
+			db.SetConnMaxLifetime(time.Duration(c.MaxConnTtl) * time.Second)
+		}
+	}
+
+	// the logger decides what to print, so every query must reach it unless none can be printed,
+	// then only errors are logged
+	l := NewLogger(p.logger, c)
+	orm.SetLogger(l)
+
+	if l.detailed() {
+		orm.LogMode(true)
+	}
+
+	return orm.Set(loggerKey, l), nil
+}
+
+// replace the client of name and return the previous one, the caller must hold the lock
+func (p *Pool) swap(name string, orm *gorm.DB) *gorm.DB {
+	if p.monitor != nil {
+		instrument(name, orm, p.monitor)
+	}
+
+	old := p.clients[name]
+	p.clients[name] = orm
+
+	return old
+}
+
+// wait for in-flight queries of a replaced client before closing it
+func (p *Pool) drain(name string, orm *gorm.DB) error {
+	deadline := time.Now().Add(drainTimeout)
+
+	for time.Now().Before(deadline) {
+		if db := orm.DB(); db == nil || db.Stats().InUse == 0 {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	err := orm.Close()
+
+	if err != nil {
+		p.logger.Errorf("can't close gorm client | name: %s | error: %s", name, err)
+	}
+
+	return err
 }
 
 func (p *Pool) Add(name string, c *Config) error {
+	orm, err := p.open(c)
+
+	if err != nil {
+		return err
+	}
+
 	p.locker.Lock()
-	defer p.locker.Unlock()
+	old := p.swap(name, orm)
+	p.locker.Unlock()
+
+	if old != nil {
+		go p.drain(name, old)
+	}
+
+	return nil
+}
 
-	orm, err := gorm.Open("mysql", c.GetDsn())
+// swap in a new client of name only after it's reachable, then drain the old one.
+// a *gorm.DB got before stops working once drained, get the client again instead of keeping it
+func (p *Pool) Reload(name string, c *Config) error {
+	if _, err := p.Get(name); err != nil {
+		return err
+	}
+
+	orm, err := p.open(c)
 
 	if err != nil {
 		return err
 	}
 
-	db := orm.DB()
+	if err = orm.DB().Ping(); err != nil {
+		_ = orm.Close()
+		return err
+	}
 
-	if c.MaxIdleConns > 0 {
-		db.SetMaxIdleConns(c.MaxIdleConns)
+	p.locker.Lock()
+	old := p.swap(name, orm)
+	p.locker.Unlock()
+
+	if old != nil {
+		go p.drain(name, old)
 	}
 
-	if c.MaxOpenConns > 0 {
-		db.SetMaxOpenConns(c.MaxOpenConns)
+	return nil
+}
+
+// like Reload, a *gorm.DB of name got before stops working once drained
+func (p *Pool) Remove(name string) error {
+	p.locker.Lock()
+	client, ok := p.clients[name]
+	delete(p.clients, name)
+	p.locker.Unlock()
+
+	if !ok {
+		return errors.New("no gorm client")
 	}
 
-	if c.MaxConnTtl > 0 {
-		db.SetConnMaxLifetime(time.Duration(c.MaxConnTtl) * time.Second)
+	return p.drain(name, client)
+}
+
+func (p *Pool) Names() []string {
+	p.locker.RLock()
+	defer p.locker.RUnlock()
+
+	names := make([]string, 0, len(p.clients))
+
+	for name := range p.clients {
+		names = append(names, name)
 	}
 
-	if c.Debug {
-		orm.LogMode(true)
+	sort.Strings(names)
+	return names
+}
+
+// drain all the clients at once, so closing takes drainTimeout at most
+func (p *Pool) Close() error {
+	p.locker.Lock()
+	clients := p.clients
+	p.clients = make(map[string]*gorm.DB, 64)
+	p.locker.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(clients))
+
+	for name, client := range clients {
+		wg.Add(1)
+
+		go func(name string, client *gorm.DB) {
+			defer wg.Done()
+			errs <- p.drain(name, client)
+		}(name, client)
 	}
 
-	orm.SetLogger(&Logger{p.logger})
-	p.clients[name] = orm
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -109,7 +401,17 @@ func (p *Pool) Get(name string) (*gorm.DB, error) {
 		return client, nil
 	}
 
-	return nil, errors.New("no mysql gorm client")
+	return nil, errors.New("no gorm client")
+}
+
+func (p *Pool) GetContext(ctx context.Context, name string) (*gorm.DB, error) {
+	client, err := p.Get(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return WithContext(client, ctx), nil
 }
 
 func NewPool(logger *logger.Logger) *Pool {
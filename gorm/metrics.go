@@ -0,0 +1,199 @@
+package gorm
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+	"github.com/opay-o2o/golib/prometheus"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+const (
+	QueryDurationVector = "gorm_query_duration_seconds"
+	QueryErrorVector    = "gorm_query_errors_total"
+
+	startTimeKey = "golib:start_time"
+)
+
+var operations = map[string]func(c *gorm.Callback) *gorm.CallbackProcessor{
+	"create":    (*gorm.Callback).Create,
+	"query":     (*gorm.Callback).Query,
+	"update":    (*gorm.Callback).Update,
+	"delete":    (*gorm.Callback).Delete,
+	"row_query": (*gorm.Callback).RowQuery,
+}
+
+func instrument(name string, orm *gorm.DB, monitor *prometheus.Monitor) {
+	for op, processor := range operations {
+		operation, callback := op, "gorm:"+op
+
+		processor(orm.Callback()).Before(callback).Register("golib:before_"+op, func(scope *gorm.Scope) {
+			scope.InstanceSet(startTimeKey, time.Now())
+		})
+
+		processor(orm.Callback()).After(callback).Register("golib:after_"+op, func(scope *gorm.Scope) {
+			v, ok := scope.InstanceGet(startTimeKey)
+
+			if !ok {
+				return
+			}
+
+			start, ok := v.(time.Time)
+
+			if !ok {
+				return
+			}
+
+			duration := float64(time.Since(start).Nanoseconds()) / 1000000000
+			labels := []string{name, scope.TableName(), operation}
+			monitor.Trigger(QueryDurationVector, duration, labels...)
+
+			if err := scope.DB().Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+				monitor.Trigger(QueryErrorVector, 0, labels...)
+			}
+		})
+	}
+}
+
+// query latencies are mostly sub-second, far below the default buckets
+var queryBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// the vectors and the collector are registered once per monitor, pools sharing it join the collector
+var collectors = struct {
+	sync.Mutex
+	m map[*prometheus.Monitor]*statsCollector
+}{m: make(map[*prometheus.Monitor]*statsCollector, 1)}
+
+type statsCollector struct {
+	sync.RWMutex
+	pools        []*Pool
+	open         *prom.Desc
+	inUse        *prom.Desc
+	idle         *prom.Desc
+	waitCount    *prom.Desc
+	waitDuration *prom.Desc
+}
+
+func newStatsCollector(constLabels prom.Labels) *statsCollector {
+	labels := []string{"pool"}
+
+	return &statsCollector{
+		open:         prom.NewDesc("gorm_open_connections", "Number of established connections.", labels, constLabels),
+		inUse:        prom.NewDesc("gorm_in_use_connections", "Number of connections currently in use.", labels, constLabels),
+		idle:         prom.NewDesc("gorm_idle_connections", "Number of idle connections.", labels, constLabels),
+		waitCount:    prom.NewDesc("gorm_wait_count_total", "Total number of connections waited for.", labels, constLabels),
+		waitDuration: prom.NewDesc("gorm_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", labels, constLabels),
+	}
+}
+
+func (c *statsCollector) add(pool *Pool) {
+	c.Lock()
+	c.pools = append(c.pools, pool)
+	c.Unlock()
+}
+
+func (c *statsCollector) Describe(ch chan<- *prom.Desc) {
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+}
+
+func (c *statsCollector) Collect(ch chan<- prom.Metric) {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, pool := range c.pools {
+		c.collect(pool, ch)
+	}
+}
+
+func (c *statsCollector) collect(pool *Pool, ch chan<- prom.Metric) {
+	pool.locker.RLock()
+	defer pool.locker.RUnlock()
+
+	for name, client := range pool.clients {
+		db := client.DB()
+
+		if db == nil {
+			continue
+		}
+
+		stats := db.Stats()
+		ch <- prom.MustNewConstMetric(c.open, prom.GaugeValue, float64(stats.OpenConnections), name)
+		ch <- prom.MustNewConstMetric(c.inUse, prom.GaugeValue, float64(stats.InUse), name)
+		ch <- prom.MustNewConstMetric(c.idle, prom.GaugeValue, float64(stats.Idle), name)
+		ch <- prom.MustNewConstMetric(c.waitCount, prom.CounterValue, float64(stats.WaitCount), name)
+		ch <- prom.MustNewConstMetric(c.waitDuration, prom.CounterValue, stats.WaitDuration.Seconds(), name)
+	}
+}
+
+func register(monitor *prometheus.Monitor) (*statsCollector, error) {
+	collectors.Lock()
+	defer collectors.Unlock()
+
+	if c, ok := collectors.m[monitor]; ok {
+		return c, nil
+	}
+
+	vectors := []*prometheus.VectorConfig{
+		{
+			Name:    QueryDurationVector,
+			Desc:    "gorm query duration in seconds",
+			Type:    prometheus.TypeHistogram,
+			Labels:  []string{"pool", "table", "operation"},
+			Buckets: queryBuckets,
+		},
+		{
+			Name:   QueryErrorVector,
+			Desc:   "gorm query errors",
+			Type:   prometheus.TypeCounter,
+			Labels: []string{"pool", "table", "operation"},
+		},
+	}
+
+	for _, v := range vectors {
+		if err := monitor.Register(v); err != nil {
+			return nil, err
+		}
+	}
+
+	c := newStatsCollector(monitor.ConstLabels())
+
+	if err := monitor.RegisterCollector(c); err != nil {
+		return nil, err
+	}
+
+	collectors.m[monitor] = c
+	return c, nil
+}
+
+// record query metrics of the clients added afterwards, and export their connection pool stats.
+// pools sharing a monitor are labeled by their client names, which should differ across pools.
+// setup only: callbacks can't be registered on clients already serving and the monitor registers
+// its vectors without locking, so it fails once the pool has clients
+func (p *Pool) EnableMetrics(monitor *prometheus.Monitor) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.monitor != nil {
+		return nil
+	}
+
+	if len(p.clients) > 0 {
+		return errors.New("gorm metrics must be enabled before adding clients")
+	}
+
+	collector, err := register(monitor)
+
+	if err != nil {
+		return err
+	}
+
+	collector.add(p)
+	p.monitor = monitor
+
+	return nil
+}
@@ -0,0 +1,461 @@
+package gorm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/opay-o2o/golib/logger"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	migrationTable   = "schema_migrations"
+	migrationLock    = "schema_migrations_lock"
+	migrationTimeout = 60
+)
+
+var (
+	migrationFileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+	dollarQuoteRegexp   = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+)
+
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	UpFunc   func(tx *gorm.DB) error
+	DownFunc func(tx *gorm.DB) error
+}
+
+func (m *Migration) run(tx *gorm.DB, up bool) error {
+	script, fn := m.Down, m.DownFunc
+
+	if up {
+		script, fn = m.Up, m.UpFunc
+	}
+
+	if fn != nil {
+		return fn(tx)
+	}
+
+	for _, stmt := range SplitStatements(script, tx.Dialect().GetName()) {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return fmt.Errorf("migration %d_%s: %s", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+type schemaMigration struct {
+	Version   int64     `gorm:"primary_key;auto_increment:false"`
+	Name      string    `gorm:"type:varchar(255);not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (schemaMigration) TableName() string {
+	return migrationTable
+}
+
+// each migration runs in a transaction with its schema_migrations row, but mysql commits
+// every DDL statement implicitly, so a migration failing halfway there keeps the statements
+// before the failing one without its row, fix the schema by hand before running it again
+type Migrator struct {
+	db         *gorm.DB
+	logger     *logger.Logger
+	migrations []*Migration
+	versions   map[int64]*Migration
+	lockName   string
+	timeout    int
+}
+
+func (m *Migrator) Register(migrations ...*Migration) error {
+	for _, migration := range migrations {
+		if _, ok := m.versions[migration.Version]; ok {
+			return fmt.Errorf("duplicate migration version %d", migration.Version)
+		}
+
+		m.versions[migration.Version] = migration
+		m.migrations = append(m.migrations, migration)
+	}
+
+	sort.Slice(m.migrations, func(i, j int) bool {
+		return m.migrations[i].Version < m.migrations[j].Version
+	})
+
+	return nil
+}
+
+// load migrations named like 0001_create_users.up.sql and 0001_create_users.down.sql
+func (m *Migrator) LoadDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[int64]*Migration, len(files))
+	var migrations []*Migration
+
+	for _, f := range files {
+		matches := migrationFileRegexp.FindStringSubmatch(f.Name())
+
+		if f.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+
+		if err != nil {
+			return err
+		}
+
+		migration, ok := loaded[version]
+
+		if !ok {
+			migration = &Migration{Version: version, Name: matches[2]}
+			loaded[version] = migration
+			migrations = append(migrations, migration)
+		} else if migration.Name != matches[2] {
+			return fmt.Errorf("migration %d has different names: %s, %s", version, migration.Name, matches[2])
+		}
+
+		if matches[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	return m.Register(migrations...)
+}
+
+// read only, a missing schema_migrations table means nothing is applied yet
+func (m *Migrator) applied() (map[int64]bool, error) {
+	if !m.db.HasTable(&schemaMigration{}) {
+		return map[int64]bool{}, nil
+	}
+
+	var rows []*schemaMigration
+
+	if err := m.db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	versions := make(map[int64]bool, len(rows))
+
+	for _, row := range rows {
+		versions[row.Version] = true
+	}
+
+	return versions, nil
+}
+
+func (m *Migrator) Pending() ([]*Migration, error) {
+	applied, err := m.applied()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []*Migration
+
+	for _, migration := range m.migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// apply all pending migrations in version order
+func (m *Migrator) Up() error {
+	return m.locked(func() error {
+		if err := m.db.AutoMigrate(&schemaMigration{}).Error; err != nil {
+			return err
+		}
+
+		pending, err := m.Pending()
+
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range pending {
+			start := time.Now()
+
+			err := transaction(m.db, func(tx *gorm.DB) error {
+				if err := migration.run(tx, true); err != nil {
+					return err
+				}
+
+				row := &schemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+				return tx.Create(row).Error
+			})
+
+			if err != nil {
+				return err
+			}
+
+			m.logger.Infof("migration applied | version: %d | name: %s | time: %v", migration.Version, migration.Name, time.Since(start))
+		}
+
+		return nil
+	})
+}
+
+// roll back the last steps applied migrations
+func (m *Migrator) Down(steps int) error {
+	return m.locked(func() error {
+		applied, err := m.applied()
+
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := m.migrations[i]
+
+			if !applied[migration.Version] {
+				continue
+			}
+
+			start := time.Now()
+
+			err := transaction(m.db, func(tx *gorm.DB) error {
+				if err := migration.run(tx, false); err != nil {
+					return err
+				}
+
+				return tx.Delete(&schemaMigration{Version: migration.Version}).Error
+			})
+
+			if err != nil {
+				return err
+			}
+
+			m.logger.Infof("migration rolled back | version: %d | name: %s | time: %v", migration.Version, migration.Name, time.Since(start))
+			steps--
+		}
+
+		return nil
+	})
+}
+
+// write the statements of pending migrations without executing them
+func (m *Migrator) DryRun(w io.Writer) error {
+	pending, err := m.Pending()
+
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		if _, err := fmt.Fprintf(w, "-- %d_%s\n", migration.Version, migration.Name); err != nil {
+			return err
+		}
+
+		if migration.UpFunc != nil {
+			if _, err := fmt.Fprintf(w, "-- go migration, statements unknown until executed\n"); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		for _, stmt := range SplitStatements(migration.Up, m.db.Dialect().GetName()) {
+			if _, err := fmt.Fprintf(w, "%s;\n", strings.TrimSuffix(stmt, ";")); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// only one process may migrate at a time, others wait on the advisory lock
+func (m *Migrator) locked(fn func() error) error {
+	dialect := m.db.Dialect().GetName()
+
+	if dialect != DriverMysql && dialect != DriverPostgres {
+		return fn()
+	}
+
+	db := m.db.DB()
+
+	if db == nil {
+		return errors.New("migrator needs a *sql.DB connection")
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	var unlock string
+	var key interface{}
+
+	switch dialect {
+	case DriverMysql:
+		var acquired sql.NullInt64
+
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", m.lockName, m.timeout).Scan(&acquired); err != nil {
+			return err
+		}
+
+		if acquired.Int64 != 1 {
+			return fmt.Errorf("can't acquire migration lock %s in %ds", m.lockName, m.timeout)
+		}
+
+		unlock, key = "SELECT RELEASE_LOCK(?)", m.lockName
+	case DriverPostgres:
+		key = int64(crc32.ChecksumIEEE([]byte(m.lockName)))
+
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+			return err
+		}
+
+		unlock = "SELECT pg_advisory_unlock($1)"
+	}
+
+	defer func() {
+		if _, err := conn.ExecContext(ctx, unlock, key); err != nil {
+			m.logger.Errorf("can't release migration lock | name: %s | error: %s", m.lockName, err)
+		}
+	}()
+
+	return fn()
+}
+
+func transaction(db *gorm.DB, fn func(tx *gorm.DB) error) (err error) {
+	tx := db.Begin()
+
+	if err = tx.Error; err != nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit().Error
+		}
+	}()
+
+	err = fn(tx)
+	return
+}
+
+func NewMigrator(db *gorm.DB, l *logger.Logger) *Migrator {
+	return &Migrator{
+		db:       db,
+		logger:   l,
+		versions: make(map[int64]*Migration, 64),
+		lockName: migrationLock,
+		timeout:  migrationTimeout,
+	}
+}
+
+func (p *Pool) Migrator(name string) (*Migrator, error) {
+	client, err := p.Get(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMigrator(client, p.logger), nil
+}
+
+// split a sql script into statements on semicolons outside quotes and comments, as the dialect
+// of the driver writes them: # comments and backslash escapes for mysql, $tag$ quoting for postgres
+func SplitStatements(script, dialect string) []string {
+	var stmts []string
+	var quote byte
+	mysql, postgres := dialect == DriverMysql, dialect == DriverPostgres
+	start := 0
+	// the statement has more than comments and spaces, mysql rejects an empty query
+	code := false
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && mysql && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote, code = c, true
+		case c == '$' && postgres:
+			code = true
+			tag := dollarQuoteRegexp.FindString(script[i:])
+
+			if tag == "" {
+				break
+			}
+
+			if end := strings.Index(script[i+len(tag):], tag); end >= 0 {
+				i += len(tag) + end + len(tag) - 1
+			} else {
+				i = len(script)
+			}
+		case c == '-' && i+1 < len(script) && script[i+1] == '-', c == '#' && mysql:
+			if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(script)
+			}
+		case c == '/' && i+1 < len(script) && script[i+1] == '*':
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(script)
+			}
+		case c == ';':
+			if code {
+				stmts = append(stmts, strings.TrimSpace(script[start:i]))
+			}
+
+			start, code = i+1, false
+		case c > ' ':
+			code = true
+		}
+	}
+
+	if code {
+		stmts = append(stmts, strings.TrimSpace(script[start:]))
+	}
+
+	return stmts
+}
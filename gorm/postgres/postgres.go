@@ -0,0 +1,4 @@
+// import for side effects to use DriverPostgres, the mysql driver is the only one golib/gorm registers
+package postgres
+
+import _ "github.com/jinzhu/gorm/dialects/postgres"
@@ -0,0 +1,304 @@
+package gorm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	StrategyMod   = "mod"
+	StrategyRange = "range"
+	StrategyHash  = "hash"
+
+	virtualNodes = 160
+)
+
+type Shard struct {
+	Pool   string `toml:"pool" json:"pool"`
+	Table  string `toml:"table" json:"table"`
+	Min    int64  `toml:"min" json:"min"`
+	Max    int64  `toml:"max" json:"max"`
+	Weight int    `toml:"weight" json:"weight"`
+}
+
+// Max of a range shard is exclusive, 0 means unbounded
+func (s *Shard) contains(key int64) bool {
+	return key >= s.Min && (s.Max == 0 || key < s.Max)
+}
+
+type ShardConfig struct {
+	Table    string   `toml:"table" json:"table"`
+	Key      string   `toml:"key" json:"key"`
+	Strategy string   `toml:"strategy" json:"strategy"`
+	Shards   []*Shard `toml:"shards" json:"shards"`
+}
+
+type shardTable struct {
+	config *ShardConfig
+	ring   []uint32
+	nodes  map[uint32]*Shard
+}
+
+func newShardTable(c *ShardConfig) (*shardTable, error) {
+	if len(c.Shards) == 0 {
+		return nil, fmt.Errorf("no shards of table %s", c.Table)
+	}
+
+	t := &shardTable{config: c}
+
+	switch c.Strategy {
+	case StrategyMod, StrategyRange:
+	case StrategyHash:
+		t.nodes = make(map[uint32]*Shard, len(c.Shards)*virtualNodes)
+
+		for _, shard := range c.Shards {
+			weight := shard.Weight
+
+			if weight <= 0 {
+				weight = 1
+			}
+
+			for i := 0; i < virtualNodes*weight; i++ {
+				hash := crc32.ChecksumIEEE([]byte(shard.Pool + "/" + shard.Table + "#" + strconv.Itoa(i)))
+
+				if _, ok := t.nodes[hash]; !ok {
+					t.nodes[hash] = shard
+					t.ring = append(t.ring, hash)
+				}
+			}
+		}
+
+		sort.Slice(t.ring, func(i, j int) bool { return t.ring[i] < t.ring[j] })
+	default:
+		return nil, fmt.Errorf("invalid shard strategy %s of table %s", c.Strategy, c.Table)
+	}
+
+	return t, nil
+}
+
+func (t *shardTable) locate(key interface{}) (*Shard, error) {
+	switch t.config.Strategy {
+	case StrategyMod:
+		n := shardInt(key) % int64(len(t.config.Shards))
+
+		if n < 0 {
+			n = -n
+		}
+
+		return t.config.Shards[n], nil
+	case StrategyRange:
+		n := shardInt(key)
+
+		for _, shard := range t.config.Shards {
+			if shard.contains(n) {
+				return shard, nil
+			}
+		}
+
+		return nil, fmt.Errorf("no shard of table %s for key %d", t.config.Table, n)
+	default:
+		hash := crc32.ChecksumIEEE([]byte(fmt.Sprint(key)))
+		i := sort.Search(len(t.ring), func(i int) bool { return t.ring[i] >= hash })
+
+		if i == len(t.ring) {
+			i = 0
+		}
+
+		return t.nodes[t.ring[i]], nil
+	}
+}
+
+// integer keys are used as is, other keys are hashed
+func shardInt(key interface{}) int64 {
+	v := reflect.ValueOf(key)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(v.Uint() & (1<<63 - 1))
+	case reflect.String:
+		if n, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return n
+		}
+	}
+
+	return int64(crc32.ChecksumIEEE([]byte(fmt.Sprint(key))))
+}
+
+type Sharding struct {
+	locker sync.RWMutex
+	pool   *Pool
+	tables map[string]*shardTable
+}
+
+func (s *Sharding) Register(c *ShardConfig) error {
+	t, err := newShardTable(c)
+
+	if err != nil {
+		return err
+	}
+
+	s.locker.Lock()
+	s.tables[c.Table] = t
+	s.locker.Unlock()
+
+	return nil
+}
+
+func (s *Sharding) table(name string) (*shardTable, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+
+	t, ok := s.tables[name]
+
+	if !ok {
+		return nil, fmt.Errorf("no sharding table %s", name)
+	}
+
+	return t, nil
+}
+
+func (s *Sharding) Locate(table string, key interface{}) (*Shard, error) {
+	t, err := s.table(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.locate(key)
+}
+
+// get the db of the shard holding key, scoped to its physical table
+func (s *Sharding) Get(table string, key interface{}) (*gorm.DB, error) {
+	shard, err := s.Locate(table, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.pool.Get(shard.Pool)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Table(shard.Table), nil
+}
+
+// get the db for a model whose shard key is read from the column named by ShardConfig.Key
+func (s *Sharding) GetByModel(table string, value interface{}) (*gorm.DB, error) {
+	t, err := s.table(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.pool.Get(t.config.Shards[0].Pool)
+
+	if err != nil {
+		return nil, err
+	}
+
+	field, ok := client.NewScope(value).FieldByName(t.config.Key)
+
+	if !ok {
+		return nil, fmt.Errorf("no shard key %s in %T", t.config.Key, value)
+	}
+
+	return s.Get(table, field.Field.Interface())
+}
+
+// get the dbs of all shards of table, scoped to their physical tables
+func (s *Sharding) All(table string) ([]*gorm.DB, error) {
+	t, err := s.table(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dbs := make([]*gorm.DB, 0, len(t.config.Shards))
+
+	for _, shard := range t.config.Shards {
+		client, err := s.pool.Get(shard.Pool)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dbs = append(dbs, client.Table(shard.Table))
+	}
+
+	return dbs, nil
+}
+
+// run fn on every shard of table concurrently, returns the first error
+func (s *Sharding) Scatter(table string, fn func(db *gorm.DB) error) error {
+	dbs, err := s.All(table)
+
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(dbs))
+
+	for i, db := range dbs {
+		wg.Add(1)
+
+		go func(i int, db *gorm.DB) {
+			defer wg.Done()
+			errs[i] = fn(db)
+		}(i, db)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// query every shard of table with scope and append all rows into out, a pointer to slice
+func (s *Sharding) Find(table string, out interface{}, scope func(db *gorm.DB) *gorm.DB) error {
+	dest := reflect.ValueOf(out)
+
+	if dest.Kind() != reflect.Ptr || dest.Elem().Kind() != reflect.Slice {
+		return errors.New("sharding find needs a pointer to slice")
+	}
+
+	var locker sync.Mutex
+	sliceType := dest.Elem().Type()
+
+	return s.Scatter(table, func(db *gorm.DB) error {
+		rows := reflect.New(sliceType)
+
+		if scope != nil {
+			db = scope(db)
+		}
+
+		if err := db.Find(rows.Interface()).Error; err != nil {
+			return err
+		}
+
+		locker.Lock()
+		dest.Elem().Set(reflect.AppendSlice(dest.Elem(), rows.Elem()))
+		locker.Unlock()
+
+		return nil
+	})
+}
+
+func NewSharding(p *Pool) *Sharding {
+	return &Sharding{pool: p, tables: make(map[string]*shardTable, 16)}
+}
@@ -0,0 +1,4 @@
+// import for side effects to use DriverSqlite, it needs cgo to build the sqlite amalgamation
+package sqlite
+
+import _ "github.com/jinzhu/gorm/dialects/sqlite"
@@ -0,0 +1,314 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RoundRobin    = "round_robin"
+	LeastInflight = "least_inflight"
+	PowerOfTwo    = "p2c"
+)
+
+var ErrNoAddress = errors.New("no grpc address available")
+
+type Resolver interface {
+	Resolve() ([]string, error)
+}
+
+type StaticResolver []string
+
+func (r StaticResolver) Resolve() ([]string, error) {
+	return r, nil
+}
+
+type BalanceConfig struct {
+	Strategy    string `toml:"strategy"`
+	EjectErrors int    `toml:"eject_errors"`
+	EjectTime   int    `toml:"eject_time"`
+	MaxEjected  int    `toml:"max_ejected"`
+	Refresh     int    `toml:"refresh"`
+}
+
+type node struct {
+	addr         string
+	inflight     int64
+	unavailable  int64
+	ejectedUntil int64
+}
+
+func (n *node) ejected(now int64) bool {
+	return atomic.LoadInt64(&n.ejectedUntil) > now
+}
+
+type ServiceClient struct {
+	sync.RWMutex
+	config   *BalanceConfig
+	pool     *Pool
+	resolver Resolver
+	nodes    []*node
+	next     uint64
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type ServiceConn struct {
+	*Connection
+	node     *node
+	client   *ServiceClient
+	released int32
+}
+
+// record the result of a call on the connection and give it back to the pool,
+// only the first call of Done or Close counts
+func (c *ServiceConn) Done(err error) {
+	if !atomic.CompareAndSwapInt32(&c.released, 0, 1) {
+		return
+	}
+
+	atomic.AddInt64(&c.node.inflight, -1)
+	c.client.record(c.node, err)
+	c.Connection.Close()
+}
+
+func (c *ServiceConn) Close() {
+	c.Done(nil)
+}
+
+func NewServiceClient(pool *Pool, resolver Resolver, c *BalanceConfig) (*ServiceClient, error) {
+	if c.Strategy == "" {
+		c.Strategy = RoundRobin
+	}
+
+	if c.EjectErrors <= 0 {
+		c.EjectErrors = 5
+	}
+
+	if c.EjectTime <= 0 {
+		c.EjectTime = 30
+	}
+
+	if c.MaxEjected <= 0 || c.MaxEjected > 100 {
+		c.MaxEjected = 50
+	}
+
+	client := &ServiceClient{config: c, pool: pool, resolver: resolver}
+
+	if err := client.Refresh(); err != nil {
+		return nil, err
+	}
+
+	if c.Refresh > 0 {
+		client.done = make(chan struct{})
+		go client.watch(time.Duration(c.Refresh) * time.Second)
+	}
+
+	return client, nil
+}
+
+// resolve the addresses again, keeping the stats of the ones still present
+func (c *ServiceClient) Refresh() error {
+	addrs, err := c.resolver.Resolve()
+
+	if err != nil {
+		return err
+	}
+
+	if len(addrs) == 0 {
+		return ErrNoAddress
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	old := make(map[string]*node, len(c.nodes))
+
+	for _, n := range c.nodes {
+		old[n.addr] = n
+	}
+
+	nodes := make([]*node, 0, len(addrs))
+
+	for _, addr := range addrs {
+		if n, ok := old[addr]; ok {
+			nodes = append(nodes, n)
+		} else {
+			nodes = append(nodes, &node{addr: addr})
+		}
+	}
+
+	c.nodes = nodes
+	return nil
+}
+
+func (c *ServiceClient) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = c.Refresh()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *ServiceClient) Stop() {
+	c.stopOnce.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+}
+
+func (c *ServiceClient) Addrs() []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	addrs := make([]string, 0, len(c.nodes))
+
+	for _, n := range c.nodes {
+		addrs = append(addrs, n.addr)
+	}
+
+	return addrs
+}
+
+// nodes not ejected, all nodes are candidates once too many of them are ejected
+func (c *ServiceClient) candidates(exclude map[*node]bool) []*node {
+	c.RLock()
+	defer c.RUnlock()
+
+	now := time.Now().UnixNano()
+	all := make([]*node, 0, len(c.nodes))
+	healthy := make([]*node, 0, len(c.nodes))
+
+	for _, n := range c.nodes {
+		if exclude[n] {
+			continue
+		}
+
+		all = append(all, n)
+
+		if !n.ejected(now) {
+			healthy = append(healthy, n)
+		}
+	}
+
+	if len(c.nodes) > 0 && (len(c.nodes)-len(healthy))*100/len(c.nodes) > c.config.MaxEjected {
+		return all
+	}
+
+	if len(healthy) == 0 {
+		return all
+	}
+
+	return healthy
+}
+
+func (c *ServiceClient) pick(nodes []*node) *node {
+	switch c.config.Strategy {
+	case LeastInflight:
+		// start from a rotating offset so ties don't always land on the first address
+		offset := int(atomic.AddUint64(&c.next, 1) % uint64(len(nodes)))
+		best := nodes[offset]
+
+		for i := 1; i < len(nodes); i++ {
+			n := nodes[(offset+i)%len(nodes)]
+
+			if atomic.LoadInt64(&n.inflight) < atomic.LoadInt64(&best.inflight) {
+				best = n
+			}
+		}
+
+		return best
+	case PowerOfTwo:
+		if len(nodes) == 1 {
+			return nodes[0]
+		}
+
+		i := rand.Intn(len(nodes))
+		j := rand.Intn(len(nodes) - 1)
+
+		if j >= i {
+			j++
+		}
+
+		if atomic.LoadInt64(&nodes[j].inflight) < atomic.LoadInt64(&nodes[i].inflight) {
+			return nodes[j]
+		}
+
+		return nodes[i]
+	default:
+		return nodes[atomic.AddUint64(&c.next, 1)%uint64(len(nodes))]
+	}
+}
+
+func (c *ServiceClient) record(n *node, err error) {
+	if status.Code(err) != codes.Unavailable {
+		atomic.StoreInt64(&n.unavailable, 0)
+		return
+	}
+
+	if atomic.AddInt64(&n.unavailable, 1) >= int64(c.config.EjectErrors) {
+		atomic.StoreInt64(&n.unavailable, 0)
+		until := time.Now().Add(time.Duration(c.config.EjectTime) * time.Second).UnixNano()
+		atomic.StoreInt64(&n.ejectedUntil, until)
+	}
+}
+
+func (c *ServiceClient) Get() (*ServiceConn, error) {
+	return c.GetContext(context.Background())
+}
+
+// pick an address by the balance strategy and check out a connection to it
+func (c *ServiceClient) GetContext(ctx context.Context) (*ServiceConn, error) {
+	exclude := make(map[*node]bool, 4)
+	err := ErrNoAddress
+
+	for {
+		nodes := c.candidates(exclude)
+
+		if len(nodes) == 0 {
+			return nil, err
+		}
+
+		n := c.pick(nodes)
+		conn, e := c.pool.GetContext(ctx, n.addr)
+
+		if e == context.Canceled || e == context.DeadlineExceeded {
+			return nil, e
+		}
+
+		if e != nil {
+			exclude[n], err = true, e
+			continue
+		}
+
+		atomic.AddInt64(&n.inflight, 1)
+		return &ServiceConn{Connection: conn, node: n, client: c}, nil
+	}
+}
+
+func (c *ServiceClient) Invoke(ctx context.Context, method string, req, resp interface{}, options ...grpc.CallOption) error {
+	conn, err := c.GetContext(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	err = conn.GetConn().Invoke(ctx, method, req, resp, options...)
+	conn.Done(err)
+
+	return err
+}
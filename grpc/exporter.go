@@ -0,0 +1,197 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/opay-o2o/golib/logger"
+	"google.golang.org/grpc/codes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type LogExporter struct {
+	logger *logger.Logger
+}
+
+func (e *LogExporter) Export(service string, spans []*Span) error {
+	for _, span := range spans {
+		span.Lock()
+		keys := make([]string, 0, len(span.Attributes))
+
+		for k := range span.Attributes {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		attrs := make([]string, 0, len(keys))
+
+		for _, k := range keys {
+			attrs = append(attrs, k+"="+span.Attributes[k])
+		}
+
+		e.logger.Infof("span: %s | service: %s | trace: %s | id: %s | parent: %s | %v | %s | %s",
+			span.Name, service, span.Context.TraceId, span.Context.SpanId, span.ParentId, span.End.Sub(span.Start),
+			codes.Code(span.Code), strings.Join(attrs, " "))
+		span.Unlock()
+	}
+
+	return nil
+}
+
+func NewLogExporter(l *logger.Logger) *LogExporter {
+	return &LogExporter{logger: l}
+}
+
+type OtlpConfig struct {
+	Endpoint string            `toml:"endpoint"`
+	Headers  map[string]string `toml:"headers"`
+	Timeout  int               `toml:"timeout"`
+}
+
+// export spans to an opentelemetry collector with the otlp/http json encoding
+type OtlpExporter struct {
+	config *OtlpConfig
+	client *http.Client
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (e *OtlpExporter) encode(service string, spans []*Span) ([]byte, error) {
+	scope := &otlpScopeSpans{Spans: make([]*otlpSpan, 0, len(spans))}
+	scope.Scope.Name = "github.com/opay-o2o/golib/grpc"
+
+	for _, span := range spans {
+		span.Lock()
+		s := &otlpSpan{
+			TraceId:           span.Context.TraceId.String(),
+			SpanId:            span.Context.SpanId.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: unixNano(span.Start),
+			EndTimeUnixNano:   unixNano(span.End),
+			Status:            otlpStatus{Code: 1},
+		}
+
+		if span.ParentId != (SpanId{}) {
+			s.ParentSpanId = span.ParentId.String()
+		}
+
+		if codes.Code(span.Code) != codes.OK {
+			s.Status = otlpStatus{Code: 2, Message: span.Message}
+		}
+
+		for k, v := range span.Attributes {
+			s.Attributes = append(s.Attributes, otlpAttribute{k, otlpValue{v}})
+		}
+
+		span.Unlock()
+		scope.Spans = append(scope.Spans, s)
+	}
+
+	resource := &otlpResourceSpans{ScopeSpans: []*otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpAttribute{{"service.name", otlpValue{service}}}
+
+	return json.Marshal(&otlpRequest{ResourceSpans: []*otlpResourceSpans{resource}})
+}
+
+func (e *OtlpExporter) Export(service string, spans []*Span) error {
+	body, err := e.encode(service, spans)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.config.Endpoint, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error http code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Endpoint is the full traces url of the collector, like http://127.0.0.1:4318/v1/traces,
+// the service name comes from the tracer
+func NewOtlpExporter(c *OtlpConfig) *OtlpExporter {
+	if c.Timeout <= 0 {
+		c.Timeout = 5
+	}
+
+	return &OtlpExporter{
+		config: c,
+		client: &http.Client{Timeout: time.Duration(c.Timeout) * time.Second},
+	}
+}
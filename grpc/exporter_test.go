@@ -0,0 +1,110 @@
+package grpc
+
+import (
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// a collector stub keeping the requests it received
+type collector struct {
+	server   *httptest.Server
+	code     int
+	requests chan *http.Request
+	bodies   chan *otlpRequest
+}
+
+func newCollector(code int) *collector {
+	c := &collector{code: code, requests: make(chan *http.Request, 16), bodies: make(chan *otlpRequest, 16)}
+
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := &otlpRequest{}
+
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		c.requests <- r
+		c.bodies <- body
+		w.WriteHeader(c.code)
+	}))
+
+	return c
+}
+
+func newSpan(name string, parent SpanId, err error) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       SpanKindServer,
+		ParentId:   parent,
+		Start:      time.Unix(100, 0),
+		End:        time.Unix(100, 5000),
+		Attributes: map[string]string{"rpc.method": name},
+	}
+
+	newIds(&span.Context.TraceId, &span.Context.SpanId)
+	st := status.Convert(err)
+	span.Code, span.Message = uint32(st.Code()), st.Message()
+
+	return span
+}
+
+func TestOtlpExporter(t *testing.T) {
+	c := newCollector(http.StatusOK)
+	defer c.server.Close()
+
+	exporter := NewOtlpExporter(&OtlpConfig{Endpoint: c.server.URL + "/v1/traces", Headers: map[string]string{"X-Token": "secret"}})
+	ok, failed := newSpan("/a.B/Ok", SpanId{}, nil), newSpan("/a.B/Fail", SpanId{1}, status.Error(codes.NotFound, "gone"))
+
+	if err := exporter.Export("orders", []*Span{ok, failed}); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+
+	r, body := <-c.requests, <-c.bodies
+
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Token") != "secret" {
+		t.Fatalf("unexpected request: %s %v", r.URL.Path, r.Header)
+	}
+
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected resource spans: %+v", body.ResourceSpans)
+	}
+
+	resource := body.ResourceSpans[0]
+
+	if attrs := resource.Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || attrs[0].Value.StringValue != "orders" {
+		t.Fatalf("unexpected resource attributes: %+v", attrs)
+	}
+
+	spans := resource.ScopeSpans[0].Spans
+
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+
+	if s := spans[0]; s.TraceId != ok.Context.TraceId.String() || s.SpanId != ok.Context.SpanId.String() || s.ParentSpanId != "" ||
+		s.Status.Code != 1 || s.StartTimeUnixNano != "100000000000" || s.EndTimeUnixNano != "100000005000" {
+		t.Fatalf("unexpected ok span: %+v", s)
+	}
+
+	if s := spans[1]; s.ParentSpanId != failed.ParentId.String() || s.Status.Code != 2 || s.Status.Message != "gone" {
+		t.Fatalf("unexpected failed span: %+v", s)
+	}
+}
+
+func TestOtlpExporterHttpError(t *testing.T) {
+	c := newCollector(http.StatusServiceUnavailable)
+	defer c.server.Close()
+
+	exporter := NewOtlpExporter(&OtlpConfig{Endpoint: c.server.URL})
+
+	if err := exporter.Export("orders", []*Span{newSpan("/a.B/Ok", SpanId{}, errors.New("boom"))}); err == nil {
+		t.Fatal("export succeeded on a 503 response")
+	}
+}
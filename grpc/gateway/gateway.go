@@ -0,0 +1,256 @@
+// json/http gateway for the unary methods of a grpc.Router, kept apart so grpc users don't pull in iris
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/kataras/iris"
+	irisContext "github.com/kataras/iris/context"
+	"github.com/opay-o2o/golib/grpc"
+	"github.com/opay-o2o/golib/http"
+	"github.com/opay-o2o/golib/logger"
+	ggrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	stdHttp "net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// http headers with this prefix are forwarded as grpc metadata, without the prefix
+	MetadataPrefix = "Grpc-Metadata-"
+	// the default max receive size of a grpc server
+	DefaultMaxBodySize = 4 * 1024 * 1024
+)
+
+var httpCodes = map[codes.Code]int{
+	codes.OK:                 stdHttp.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            stdHttp.StatusInternalServerError,
+	codes.InvalidArgument:    stdHttp.StatusBadRequest,
+	codes.DeadlineExceeded:   stdHttp.StatusGatewayTimeout,
+	codes.NotFound:           stdHttp.StatusNotFound,
+	codes.AlreadyExists:      stdHttp.StatusConflict,
+	codes.PermissionDenied:   stdHttp.StatusForbidden,
+	codes.ResourceExhausted:  stdHttp.StatusTooManyRequests,
+	codes.FailedPrecondition: stdHttp.StatusBadRequest,
+	codes.Aborted:            stdHttp.StatusConflict,
+	codes.OutOfRange:         stdHttp.StatusBadRequest,
+	codes.Unimplemented:      stdHttp.StatusNotImplemented,
+	codes.Internal:           stdHttp.StatusInternalServerError,
+	codes.Unavailable:        stdHttp.StatusServiceUnavailable,
+	codes.DataLoss:           stdHttp.StatusInternalServerError,
+	codes.Unauthenticated:    stdHttp.StatusUnauthorized,
+}
+
+func HttpStatusFromCode(code codes.Code) int {
+	if httpCode, ok := httpCodes[code]; ok {
+		return httpCode
+	}
+
+	return stdHttp.StatusInternalServerError
+}
+
+type gatewayMethod struct {
+	name   string
+	input  reflect.Type
+	output reflect.Type
+}
+
+// expose the unary methods of the services registered by a router as POST /package.Service/Method with json bodies
+type Gateway struct {
+	conn        *ggrpc.ClientConn
+	logger      *logger.Logger
+	methods     []*gatewayMethod
+	marshaler   *jsonpb.Marshaler
+	maxBodySize int64
+}
+
+// conn reaches the grpc server running the router, the gateway itself only proxies to it
+func NewGateway(r grpc.Router, conn *ggrpc.ClientConn, l *logger.Logger) (*Gateway, error) {
+	g := &Gateway{
+		conn:        conn,
+		logger:      l,
+		marshaler:   &jsonpb.Marshaler{OrigName: true, EmitDefaults: true},
+		maxBodySize: DefaultMaxBodySize,
+	}
+
+	// the server only collects the service descriptions, it never serves
+	server := ggrpc.NewServer()
+	r.RegGrpcService(server)
+
+	for name, info := range server.GetServiceInfo() {
+		file, ok := info.Metadata.(string)
+
+		if !ok {
+			return nil, fmt.Errorf("no proto file of grpc service %s", name)
+		}
+
+		service, err := findService(file, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range service.GetMethod() {
+			if m.GetClientStreaming() || m.GetServerStreaming() {
+				continue
+			}
+
+			input, output := proto.MessageType(strings.TrimPrefix(m.GetInputType(), ".")), proto.MessageType(strings.TrimPrefix(m.GetOutputType(), "."))
+
+			if input == nil || output == nil {
+				return nil, fmt.Errorf("unknown message type of grpc method /%s/%s", name, m.GetName())
+			}
+
+			g.methods = append(g.methods, &gatewayMethod{"/" + name + "/" + m.GetName(), input.Elem(), output.Elem()})
+		}
+	}
+
+	sort.Slice(g.methods, func(i, j int) bool { return g.methods[i].name < g.methods[j].name })
+	return g, nil
+}
+
+func findService(file, name string) (*descriptor.ServiceDescriptorProto, error) {
+	compressed := proto.FileDescriptor(file)
+
+	if compressed == nil {
+		return nil, fmt.Errorf("proto file %s isn't registered", file)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadAll(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &descriptor.FileDescriptorProto{}
+
+	if err := proto.Unmarshal(raw, fd); err != nil {
+		return nil, err
+	}
+
+	for _, service := range fd.GetService() {
+		fullName := service.GetName()
+
+		if fd.GetPackage() != "" {
+			fullName = fd.GetPackage() + "." + fullName
+		}
+
+		if fullName == name {
+			return service, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no grpc service %s in proto file %s", name, file)
+}
+
+// full names of the exposed methods, which are also their http paths
+func (g *Gateway) Methods() []string {
+	names := make([]string, 0, len(g.methods))
+
+	for _, m := range g.methods {
+		names = append(names, m.name)
+	}
+
+	return names
+}
+
+// bodies beyond size bytes are rejected with 413, <= 0 restores the default
+func (g *Gateway) SetMaxBodySize(size int64) {
+	if size <= 0 {
+		size = DefaultMaxBodySize
+	}
+
+	g.maxBodySize = size
+}
+
+func (g *Gateway) Mount(app *iris.Application) {
+	for _, m := range g.methods {
+		app.Post(m.name, g.handler(m))
+	}
+}
+
+// a trace id forwarded in the headers is kept, a new one is generated otherwise
+func outgoingContext(ctx irisContext.Context) context.Context {
+	data := metadata.MD{}
+
+	for k, v := range ctx.Request().Header {
+		if strings.HasPrefix(k, MetadataPrefix) {
+			data.Append(strings.TrimPrefix(k, MetadataPrefix), v...)
+		}
+	}
+
+	data.Set("x-forwarded-for", http.GetClientIp(ctx))
+
+	return grpc.NewTraceCtx(metadata.NewOutgoingContext(ctx.Request().Context(), data))
+}
+
+func (g *Gateway) handler(m *gatewayMethod) irisContext.Handler {
+	return func(ctx irisContext.Context) {
+		req := reflect.New(m.input).Interface().(proto.Message)
+		body, err := ioutil.ReadAll(io.LimitReader(ctx.Request().Body, g.maxBodySize+1))
+
+		if err != nil {
+			g.writeError(ctx, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+
+		if int64(len(body)) > g.maxBodySize {
+			st := status.Newf(codes.ResourceExhausted, "request body larger than %d bytes", g.maxBodySize)
+			g.writeStatus(ctx, stdHttp.StatusRequestEntityTooLarge, st)
+			return
+		}
+
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := jsonpb.Unmarshal(bytes.NewReader(body), req); err != nil {
+				g.writeError(ctx, status.Error(codes.InvalidArgument, err.Error()))
+				return
+			}
+		}
+
+		resp := reflect.New(m.output).Interface().(proto.Message)
+
+		if err := g.conn.Invoke(outgoingContext(ctx), m.name, req, resp); err != nil {
+			g.writeError(ctx, err)
+			return
+		}
+
+		out, err := g.marshaler.MarshalToString(resp)
+
+		if err != nil {
+			g.logger.Errorf("can't marshal grpc response | method: %s | error: %s", m.name, err)
+			g.writeError(ctx, status.Error(codes.Internal, err.Error()))
+			return
+		}
+
+		ctx.ContentType("application/json")
+		_, _ = ctx.WriteString(out)
+	}
+}
+
+func (g *Gateway) writeError(ctx irisContext.Context, err error) {
+	st := status.Convert(err)
+	g.writeStatus(ctx, HttpStatusFromCode(st.Code()), st)
+}
+
+func (g *Gateway) writeStatus(ctx irisContext.Context, httpCode int, st *status.Status) {
+	ctx.StatusCode(httpCode)
+	_, _ = ctx.JSON(iris.Map{"code": int(st.Code()), "message": st.Message()})
+}
@@ -0,0 +1,125 @@
+package grpc
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// make sure the incoming metadata of ctx carries a trace id, generating one if the caller sent none
+func withIncomingTraceId(ctx context.Context) context.Context {
+	data, _ := metadata.FromIncomingContext(ctx)
+
+	if v := data.Get(TraceIdKey); len(v) > 0 && v[0] != "" {
+		return ctx
+	}
+
+	data = metadata.Join(data, nil)
+	data.Set(TraceIdKey, GenTraceId())
+
+	return metadata.NewIncomingContext(ctx, data)
+}
+
+// make sure the outgoing metadata of ctx carries the trace id of the current request
+func withOutgoingTraceId(ctx context.Context) context.Context {
+	data, _ := metadata.FromOutgoingContext(ctx)
+
+	if v := data.Get(TraceIdKey); len(v) > 0 && v[0] != "" {
+		return ctx
+	}
+
+	return NewTraceCtx(ctx)
+}
+
+func TraceServerUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(withIncomingTraceId(ctx), req)
+}
+
+func TraceServerStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &serverStream{stream, withIncomingTraceId(stream.Context())})
+}
+
+func TraceClientUnaryInterceptor(ctx context.Context, method string, req, resp interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) error {
+	return invoker(withOutgoingTraceId(ctx), method, req, resp, conn, options...)
+}
+
+func TraceClientStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, conn *grpc.ClientConn, method string, streamer grpc.Streamer, options ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withOutgoingTraceId(ctx), desc, conn, method, options...)
+}
+
+// run interceptors in order, the first one is the outermost
+func ChainUnaryServer(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+
+		return next(ctx, req)
+	}
+}
+
+// run interceptors in order, the first one is the outermost
+func ChainStreamServer(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		next := handler
+
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+
+			next = func(srv interface{}, stream grpc.ServerStream) error {
+				return interceptor(srv, stream, info, inner)
+			}
+		}
+
+		return next(srv, stream)
+	}
+}
+
+// run interceptors in order, the first one is the outermost
+func ChainUnaryClient(interceptors ...grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, resp interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) error {
+		next := invoker
+
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+
+			next = func(ctx context.Context, method string, req, resp interface{}, conn *grpc.ClientConn, options ...grpc.CallOption) error {
+				return interceptor(ctx, method, req, resp, conn, inner, options...)
+			}
+		}
+
+		return next(ctx, method, req, resp, conn, options...)
+	}
+}
+
+// run interceptors in order, the first one is the outermost
+func ChainStreamClient(interceptors ...grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, conn *grpc.ClientConn, method string, streamer grpc.Streamer, options ...grpc.CallOption) (grpc.ClientStream, error) {
+		next := streamer
+
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+
+			next = func(ctx context.Context, desc *grpc.StreamDesc, conn *grpc.ClientConn, method string, options ...grpc.CallOption) (grpc.ClientStream, error) {
+				return interceptor(ctx, desc, conn, method, inner, options...)
+			}
+		}
+
+		return next(ctx, desc, conn, method, options...)
+	}
+}
@@ -1,44 +1,103 @@
 package grpc
 
 import (
+	"context"
+	"errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const defaultHealthTimeout = time.Second
+
+var (
+	ErrUnhealthy = errors.New("grpc address is not serving")
+	ErrInterval  = errors.New("reaper interval must be positive")
+)
+
 type Dialer func(addr string) (*grpc.ClientConn, error)
 
 func DefaultDialer(addr string) (*grpc.ClientConn, error) {
 	return grpc.Dial(addr, grpc.WithInsecure())
 }
 
+// Active counts the connections checked out, Idle the ones waiting in the pool
+type PoolStats struct {
+	Active     int64         `json:"active"`
+	Idle       int           `json:"idle"`
+	Waits      int64         `json:"waits"`
+	WaitTime   time.Duration `json:"wait_time"`
+	DialErrors int64         `json:"dial_errors"`
+}
+
+// connections of one address, slots bounds the open ones when max active is set
+type addrPool struct {
+	idle       chan *Connection
+	slots      chan struct{}
+	open       int64
+	waits      int64
+	waitTime   int64
+	dialErrors int64
+}
+
+func (a *addrPool) discard(c *Connection) {
+	_ = c.conn.Close()
+	atomic.AddInt64(&a.open, -1)
+
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
 type Pool struct {
 	sync.RWMutex
-	conns    map[string]chan *Connection
-	dialer   Dialer
-	capacity int
-	idle     time.Duration
-	ttl      time.Duration
+	conns         map[string]*addrPool
+	dialer        Dialer
+	capacity      int
+	maxActive     int
+	idle          time.Duration
+	ttl           time.Duration
+	healthCheck   bool
+	healthService string
+	healthTimeout time.Duration
+	unhealthy     map[string]bool
+	done          chan struct{}
 }
 
 type Connection struct {
 	addr     string
 	conn     *grpc.ClientConn
 	pool     *Pool
+	entry    *addrPool
 	createAt time.Time
 	lastUsed time.Time
 }
 
+// Capacity bounds the idle connections per address and MaxActive the open ones, checkouts beyond
+// it wait for a free one, 0 means no limit. Idle and Ttl are in seconds, 0 means no limit
+type PoolConfig struct {
+	Capacity  int `toml:"capacity"`
+	MaxActive int `toml:"max_active"`
+	Idle      int `toml:"idle"`
+	Ttl       int `toml:"ttl"`
+}
+
 func NewPool(dialer Dialer, capacity int, idle time.Duration, ttl ...time.Duration) *Pool {
 	if capacity <= 0 {
 		capacity = 1
 	}
 
 	p := &Pool{
-		conns:    make(map[string]chan *Connection, 16),
-		capacity: capacity,
-		dialer:   dialer,
-		idle:     idle,
+		conns:     make(map[string]*addrPool, 16),
+		capacity:  capacity,
+		dialer:    dialer,
+		idle:      idle,
+		unhealthy: make(map[string]bool, 16),
 	}
 
 	if len(ttl) > 0 {
@@ -48,48 +107,329 @@ func NewPool(dialer Dialer, capacity int, idle time.Duration, ttl ...time.Durati
 	return p
 }
 
-func (p *Pool) Get(addr string) (*Connection, error) {
+func NewPoolWithConfig(dialer Dialer, c *PoolConfig) *Pool {
+	p := NewPool(dialer, c.Capacity, time.Duration(c.Idle)*time.Second, time.Duration(c.Ttl)*time.Second)
+	p.maxActive = c.MaxActive
+
+	return p
+}
+
+// connections in TransientFailure or Shutdown state can't serve any request
+func usable(conn *grpc.ClientConn) bool {
+	state := conn.GetState()
+	return state != connectivity.TransientFailure && state != connectivity.Shutdown
+}
+
+func (p *Pool) expired(c *Connection) bool {
+	if p.idle > 0 && c.lastUsed.Add(p.idle).Before(time.Now()) {
+		return true
+	}
+
+	if p.ttl > 0 && c.createAt.Add(p.ttl).Before(time.Now()) {
+		return true
+	}
+
+	return false
+}
+
+func (p *Pool) entry(addr string) (*addrPool, bool) {
 	p.Lock()
-	clients, ok := p.conns[addr]
+	defer p.Unlock()
+
+	a, ok := p.conns[addr]
 
 	if !ok {
-		clients = make(chan *Connection, p.capacity)
-		p.conns[addr] = clients
+		a = &addrPool{idle: make(chan *Connection, p.capacity)}
+
+		if p.maxActive > 0 {
+			a.slots = make(chan struct{}, p.maxActive)
+		}
+
+		p.conns[addr] = a
 	}
 
-	p.Unlock()
+	return a, p.unhealthy[addr]
+}
+
+func (p *Pool) Get(addr string) (*Connection, error) {
+	return p.GetContext(context.Background(), addr)
+}
+
+// check out a connection of addr, waiting until ctx is done when max active is reached
+func (p *Pool) GetContext(ctx context.Context, addr string) (*Connection, error) {
+	a, unhealthy := p.entry(addr)
+
+	if unhealthy {
+		return nil, ErrUnhealthy
+	}
+
+	var start time.Time
 
 	for {
 		select {
-		case client := <-clients:
-			if p.idle > 0 && client.lastUsed.Add(p.idle).Before(time.Now()) {
-				_ = client.conn.Close()
+		case client := <-a.idle:
+			if p.expired(client) || !usable(client.conn) {
+				a.discard(client)
 				continue
 			}
 
-			if p.ttl > 0 && client.createAt.Add(p.ttl).Before(time.Now()) {
-				_ = client.conn.Close()
+			client.lastUsed = time.Now()
+			return client, nil
+		default:
+		}
+
+		if a.slots == nil {
+			return p.dial(addr, a)
+		}
+
+		select {
+		case a.slots <- struct{}{}:
+			return p.dial(addr, a)
+		default:
+		}
+
+		if start.IsZero() {
+			start = time.Now()
+			atomic.AddInt64(&a.waits, 1)
+		}
+
+		select {
+		case client := <-a.idle:
+			atomic.AddInt64(&a.waitTime, int64(time.Since(start)))
+
+			if p.expired(client) || !usable(client.conn) {
+				a.discard(client)
 				continue
 			}
 
 			client.lastUsed = time.Now()
 			return client, nil
-		default:
-			c, err := p.dialer(addr)
+		case a.slots <- struct{}{}:
+			atomic.AddInt64(&a.waitTime, int64(time.Since(start)))
+			return p.dial(addr, a)
+		case <-ctx.Done():
+			atomic.AddInt64(&a.waitTime, int64(time.Since(start)))
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dial a new connection, the caller must have taken a slot of a
+func (p *Pool) dial(addr string, a *addrPool) (*Connection, error) {
+	c, err := p.dialer(addr)
+
+	if err != nil {
+		atomic.AddInt64(&a.dialErrors, 1)
+
+		if a.slots != nil {
+			<-a.slots
+		}
+
+		return nil, err
+	}
+
+	atomic.AddInt64(&a.open, 1)
+
+	client := &Connection{
+		addr:     addr,
+		pool:     p,
+		entry:    a,
+		conn:     c,
+		createAt: time.Now(),
+		lastUsed: time.Now(),
+	}
+
+	return client, nil
+}
+
+func (p *Pool) Stats() map[string]*PoolStats {
+	p.RLock()
+	defer p.RUnlock()
 
-			if err != nil {
-				return nil, err
+	stats := make(map[string]*PoolStats, len(p.conns))
+
+	for addr, a := range p.conns {
+		idle := len(a.idle)
+		active := atomic.LoadInt64(&a.open) - int64(idle)
+
+		// a connection moving between the idle channel and the caller may be seen in both
+		if active < 0 {
+			active = 0
+		}
+
+		stats[addr] = &PoolStats{
+			Active:     active,
+			Idle:       idle,
+			Waits:      atomic.LoadInt64(&a.waits),
+			WaitTime:   time.Duration(atomic.LoadInt64(&a.waitTime)),
+			DialErrors: atomic.LoadInt64(&a.dialErrors),
+		}
+	}
+
+	return stats
+}
+
+// check addresses with the standard grpc health checking protocol in the reaper,
+// Get fails fast with ErrUnhealthy while an address reports not serving, timeout <= 0 means 1s
+func (p *Pool) EnableHealthCheck(service string, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.healthCheck = true
+	p.healthService = service
+	p.healthTimeout = timeout
+}
+
+// close idle, expired and broken connections every interval instead of when they're touched
+func (p *Pool) StartReaper(interval time.Duration) error {
+	if interval <= 0 {
+		return ErrInterval
+	}
+
+	p.Lock()
+
+	if p.done != nil {
+		p.Unlock()
+		return nil
+	}
+
+	p.done = make(chan struct{})
+	done := p.done
+	p.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.reap()
+			case <-done:
+				return
 			}
+		}
+	}()
+
+	return nil
+}
 
-			client := &Connection{
-				addr:     addr,
-				pool:     p,
-				conn:     c,
-				createAt: time.Now(),
-				lastUsed: time.Now(),
+func (p *Pool) reap() {
+	p.RLock()
+	conns := make(map[string]*addrPool, len(p.conns))
+
+	for addr, a := range p.conns {
+		conns[addr] = a
+	}
+
+	check, service, timeout := p.healthCheck, p.healthService, p.healthTimeout
+	p.RUnlock()
+
+	for addr, a := range conns {
+		var alive []*Connection
+
+	drain:
+		for i := len(a.idle); i > 0; i-- {
+			select {
+			case client := <-a.idle:
+				if p.expired(client) || !usable(client.conn) {
+					a.discard(client)
+				} else {
+					alive = append(alive, client)
+				}
+			default:
+				break drain
 			}
+		}
 
-			return client, nil
+		if check {
+			serving := p.checkHealth(addr, service, timeout, alive)
+
+			p.Lock()
+			p.unhealthy[addr] = !serving
+			p.Unlock()
+
+			if !serving {
+				for _, client := range alive {
+					a.discard(client)
+				}
+
+				alive = nil
+			}
+		}
+
+		for _, client := range alive {
+			select {
+			case a.idle <- client:
+			default:
+				a.discard(client)
+			}
+		}
+	}
+}
+
+func (p *Pool) checkHealth(addr, service string, timeout time.Duration, alive []*Connection) bool {
+	var conn *grpc.ClientConn
+
+	if len(alive) > 0 {
+		conn = alive[0].conn
+	} else {
+		c, err := p.dialer(addr)
+
+		if err != nil {
+			return false
+		}
+
+		defer func() {
+			_ = c.Close()
+		}()
+
+		conn = c
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+
+	// servers without the health service are taken as serving, like the health checking of grpc itself
+	if status.Code(err) == codes.Unimplemented {
+		return true
+	}
+
+	if err != nil {
+		return false
+	}
+
+	return resp.Status == grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+// stop the reaper and close all idle connections, connections in use are closed when returned
+func (p *Pool) Close() {
+	p.Lock()
+	conns := p.conns
+	p.conns = make(map[string]*addrPool, 16)
+
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+
+	p.Unlock()
+
+	for _, a := range conns {
+	drain:
+		for {
+			select {
+			case client := <-a.idle:
+				a.discard(client)
+			default:
+				break drain
+			}
 		}
 	}
 }
@@ -103,28 +443,23 @@ func (c *Connection) Close() {
 		return
 	}
 
-	if c.pool.idle > 0 && c.lastUsed.Add(c.pool.idle).Before(time.Now()) {
-		_ = c.conn.Close()
-		return
-	}
-
-	if c.pool.ttl > 0 && c.createAt.Add(c.pool.ttl).Before(time.Now()) {
-		_ = c.conn.Close()
+	if c.pool.expired(c) || !usable(c.conn) {
+		c.entry.discard(c)
 		return
 	}
 
-	c.pool.Lock()
-	clients := c.pool.conns[c.addr]
-	c.pool.Unlock()
+	c.pool.RLock()
+	current := c.pool.conns[c.addr]
+	c.pool.RUnlock()
 
-	if clients == nil {
-		_ = c.conn.Close()
+	if current != c.entry {
+		c.entry.discard(c)
 		return
 	}
 
 	select {
-	case clients <- c:
+	case c.entry.idle <- c:
 	default:
-		_ = c.conn.Close()
+		c.entry.discard(c)
 	}
 }
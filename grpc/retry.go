@@ -0,0 +1,282 @@
+package grpc
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/opay-o2o/golib/breaker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Codes are status names like "unavailable" or "DEADLINE_EXCEEDED", backoffs and HedgeDelay are in ms,
+// Jitter randomizes each backoff by up to that fraction, HedgeDelay > 0 enables hedging
+type RetryPolicy struct {
+	MaxAttempts    int      `toml:"max_attempts"`
+	Codes          []string `toml:"codes"`
+	InitialBackoff int      `toml:"initial_backoff"`
+	MaxBackoff     int      `toml:"max_backoff"`
+	Multiplier     float64  `toml:"multiplier"`
+	Jitter         float64  `toml:"jitter"`
+	HedgeDelay     int      `toml:"hedge_delay"`
+	codes          map[codes.Code]bool
+}
+
+type RetryConfig struct {
+	Default *RetryPolicy            `toml:"default"`
+	Methods map[string]*RetryPolicy `toml:"methods"`
+}
+
+func parseCode(name string) (codes.Code, bool) {
+	name = strings.Replace(name, "_", "", -1)
+
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.EqualFold(name, c.String()) {
+			return c, true
+		}
+	}
+
+	return codes.Unknown, false
+}
+
+func (p *RetryPolicy) init() {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+
+	if len(p.Codes) == 0 {
+		p.Codes = []string{"unavailable"}
+	}
+
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 100
+	}
+
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff * 10
+	}
+
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+
+	p.codes = make(map[codes.Code]bool, len(p.Codes))
+
+	for _, name := range p.Codes {
+		if c, ok := parseCode(name); ok {
+			p.codes[c] = true
+		}
+	}
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	return p.codes[status.Code(err)]
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := math.Min(float64(p.InitialBackoff)*math.Pow(p.Multiplier, float64(attempt-1)), float64(p.MaxBackoff))
+
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(d * float64(time.Millisecond))
+}
+
+type Retrier struct {
+	sync.RWMutex
+	policy  *RetryPolicy
+	methods map[string]*RetryPolicy
+}
+
+func NewRetrier(c *RetryConfig) *Retrier {
+	r := &Retrier{methods: make(map[string]*RetryPolicy, len(c.Methods))}
+
+	if c.Default != nil {
+		c.Default.init()
+		r.policy = c.Default
+	}
+
+	for method, p := range c.Methods {
+		r.SetMethod(method, p)
+	}
+
+	return r
+}
+
+// set the policy of a full method name like /pkg.Service/Method, a nil policy disables retries for it
+func (r *Retrier) SetMethod(method string, p *RetryPolicy) {
+	if p != nil {
+		p.init()
+	}
+
+	r.Lock()
+	r.methods[method] = p
+	r.Unlock()
+}
+
+func (r *Retrier) getPolicy(method string) *RetryPolicy {
+	r.RLock()
+	defer r.RUnlock()
+
+	if p, ok := r.methods[method]; ok {
+		return p
+	}
+
+	return r.policy
+}
+
+func (r *Retrier) UnaryClientInterceptor(ctx context.Context, method string, req, resp interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) error {
+	p := r.getPolicy(method)
+
+	if p == nil || p.MaxAttempts <= 1 {
+		return invoker(ctx, method, req, resp, conn, options...)
+	}
+
+	if msg, ok := resp.(proto.Message); ok && p.HedgeDelay > 0 {
+		return hedge(ctx, p, method, req, msg, conn, invoker, options...)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := invoker(ctx, method, req, resp, conn, options...)
+
+		if err == nil || attempt >= p.MaxAttempts || !p.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		timer := time.NewTimer(p.backoff(attempt))
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+type hedgeResult struct {
+	resp proto.Message
+	err  error
+}
+
+// send another copy of the request every HedgeDelay until one succeeds, the others are canceled.
+// only for idempotent methods, and call options writing headers or trailers must not be used with it
+func hedge(ctx context.Context, p *RetryPolicy, method string, req interface{}, resp proto.Message, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, p.MaxAttempts)
+	launched, pending := 0, 0
+
+	launch := func() {
+		out := proto.Clone(resp)
+		out.Reset()
+		launched++
+		pending++
+
+		go func() {
+			err := invoker(ctx, method, req, out, conn, options...)
+			results <- hedgeResult{out, err}
+		}()
+	}
+
+	launch()
+	delay := time.Duration(p.HedgeDelay) * time.Millisecond
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+
+			if result.err == nil {
+				resp.Reset()
+				proto.Merge(resp, result.resp)
+				return nil
+			}
+
+			if err = result.err; !p.retryable(err) {
+				return err
+			}
+
+			// don't wait for the hedge delay when an attempt already failed
+			if launched < p.MaxAttempts && ctx.Err() == nil {
+				launch()
+			}
+		case <-timer.C:
+			if launched < p.MaxAttempts && ctx.Err() == nil {
+				launch()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	return err
+}
+
+// a circuit breaker per target, calls fail fast with codes.Unavailable while it's open
+type CircuitBreaker struct {
+	group *breaker.Group
+}
+
+func NewCircuitBreaker(c *breaker.Config) *CircuitBreaker {
+	return &CircuitBreaker{group: breaker.NewGroup(c)}
+}
+
+func (b *CircuitBreaker) Breaker(target string) *breaker.Breaker {
+	return b.group.Get(target)
+}
+
+// only errors telling the target is down or overloaded count as failures
+func isBreakerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *CircuitBreaker) done(br *breaker.Breaker, err error) {
+	if isBreakerFailure(err) {
+		br.Failure()
+	} else {
+		br.Success()
+	}
+}
+
+func (b *CircuitBreaker) UnaryClientInterceptor(ctx context.Context, method string, req, resp interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) error {
+	br := b.group.Get(conn.Target())
+
+	if !br.Allow() {
+		return status.Errorf(codes.Unavailable, "%s | target: %s", breaker.ErrOpen, conn.Target())
+	}
+
+	err := invoker(ctx, method, req, resp, conn, options...)
+	b.done(br, err)
+
+	return err
+}
+
+// only the establishment of the stream is guarded
+func (b *CircuitBreaker) StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, conn *grpc.ClientConn, method string, streamer grpc.Streamer, options ...grpc.CallOption) (grpc.ClientStream, error) {
+	br := b.group.Get(conn.Target())
+
+	if !br.Allow() {
+		return nil, status.Errorf(codes.Unavailable, "%s | target: %s", breaker.ErrOpen, conn.Target())
+	}
+
+	stream, err := streamer(ctx, desc, conn, method, options...)
+	b.done(br, err)
+
+	return stream, err
+}
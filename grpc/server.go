@@ -2,21 +2,54 @@ package grpc
 
 import (
 	"context"
+	"fmt"
 	"github.com/opay-o2o/golib/logger"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 	"net"
+	"runtime"
 	"strconv"
+	"time"
 )
 
 type Config struct {
-	Host string `toml:"host"`
-	Port int    `toml:"port"`
+	Host           string           `toml:"host"`
+	Port           int              `toml:"port"`
+	Reflection     bool             `toml:"reflection"`
+	Tls            *TlsConfig       `toml:"tls"`
+	Keepalive      *KeepaliveConfig `toml:"keepalive"`
+	MaxRecvMsgSize int              `toml:"max_recv_msg_size"`
+	MaxSendMsgSize int              `toml:"max_send_msg_size"`
+	Timeout        int              `toml:"timeout"`
+	MethodTimeouts map[string]int   `toml:"method_timeouts"`
 }
 
 func (c *Config) GetAddr() string {
 	return c.Host + ":" + strconv.Itoa(c.Port)
 }
 
+// default deadline of a full method in ms, 0 means none
+func (c *Config) GetTimeout(method string) time.Duration {
+	if timeout, ok := c.MethodTimeouts[method]; ok {
+		return time.Duration(timeout) * time.Millisecond
+	}
+
+	return time.Duration(c.Timeout) * time.Millisecond
+}
+
+func getPeerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+
+	return "unknown"
+}
+
 type Router interface {
 	RegGrpcService(server *grpc.Server)
 }
@@ -24,6 +57,7 @@ type Router interface {
 type Server struct {
 	config   *Config
 	server   *grpc.Server
+	health   *health.Server
 	router   Router
 	logger   *logger.Logger
 	ctx      context.Context
@@ -46,26 +80,189 @@ func (s *Server) Start(options ...grpc.ServerOption) error {
 		return err
 	}
 
-	s.server = grpc.NewServer(options...)
+	return s.Serve(listener, options...)
+}
+
+// serve on a listener of the caller, such as an in-memory one in tests
+func (s *Server) Serve(listener net.Listener, options ...grpc.ServerOption) error {
+	configOptions, err := s.config.ServerOptions()
+
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+
+	s.server = grpc.NewServer(append(configOptions, options...)...)
 	s.router.RegGrpcService(s.server)
+	s.health = health.NewServer()
+
+	// every service registered by the router is serving, "" stands for the whole server
+	for name := range s.server.GetServiceInfo() {
+		s.health.SetServingStatus(name, grpc_health_v1.HealthCheckResponse_SERVING)
+	}
+
+	grpc_health_v1.RegisterHealthServer(s.server, s.health)
+
+	if s.config.Reflection {
+		reflection.Register(s.server)
+	}
+
 	s.ctx, s.canceler = context.WithCancel(context.Background())
 
 	go func() {
-		err = s.server.Serve(listener)
+		err := s.server.Serve(listener)
 
 		if err != nil && s.Running() {
-			s.logger.Errorf("can't serve at <%s>", s.config.GetAddr())
+			s.logger.Errorf("can't serve at <%s> | error: %s", listener.Addr(), err)
 		}
 	}()
 
 	return nil
 }
 
+// flip the health status of a service, "" for the whole server
+func (s *Server) SetServingStatus(service string, serving bool) {
+	status := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+
+	if serving {
+		status = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+
+	s.health.SetServingStatus(service, status)
+}
+
 func (s *Server) Stop() {
 	s.canceler()
+	s.health.Shutdown()
 	s.server.Stop()
 }
 
+// report not serving, then wait for in-flight rpcs until timeout before stopping hard
+func (s *Server) GracefulStop(timeout time.Duration) {
+	s.canceler()
+	s.health.Shutdown()
+
+	done := make(chan struct{})
+
+	go func() {
+		s.server.GracefulStop()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		s.logger.Errorf("grpc server graceful stop timeout | addr: %s | timeout: %v", s.config.GetAddr(), timeout)
+		s.server.Stop()
+		<-done
+	}
+}
+
+func (s *Server) recover(ctx context.Context, method string, err *error) {
+	if r := recover(); r != nil {
+		var stacktrace string
+
+		for i := 1; ; i++ {
+			_, f, l, got := runtime.Caller(i)
+
+			if !got {
+				break
+			}
+
+			stacktrace += fmt.Sprintf("%s:%d\n", f, l)
+		}
+
+		request := fmt.Sprintf("%s %s %s", getPeerAddr(ctx), method, GetCtxTraceId(ctx))
+		s.logger.Error(fmt.Sprintf("recovered panic:\nRequest: %s\nTrace: %s\n%s", request, r, stacktrace))
+
+		// the panic value may carry internals, it is only logged
+		*err = status.Error(codes.Internal, "internal error")
+	}
+}
+
+// recovery panic (codes.Internal)
+func (s *Server) Recovery(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer s.recover(ctx, info.FullMethod, &err)
+	return handler(ctx, req)
+}
+
+func (s *Server) StreamRecovery(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer s.recover(stream.Context(), info.FullMethod, &err)
+	return handler(srv, stream)
+}
+
+func (s *Server) accessLog(ctx context.Context, method string, start time.Time, err error) {
+	code, useTime := status.Code(err), time.Since(start)
+	s.logger.Infof("rpc: %s | %4v | %s | %s | %s", code, useTime, getPeerAddr(ctx), method, GetCtxTraceId(ctx))
+}
+
+// record access log
+func (s *Server) AccessLog(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	start := time.Now()
+	resp, err = handler(ctx, req)
+	s.accessLog(ctx, info.FullMethod, start, err)
+	return
+}
+
+func (s *Server) StreamAccessLog(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	start := time.Now()
+	err = handler(srv, stream)
+	s.accessLog(stream.Context(), info.FullMethod, start, err)
+	return
+}
+
+// a handler returning the error of the expired context would reach the client as codes.Unknown
+func deadlineError(ctx context.Context, err error) error {
+	if err == context.DeadlineExceeded && ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	return err
+}
+
+// apply the configured default deadline unless the caller set a sooner one
+func (s *Server) Deadline(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	timeout := s.config.GetTimeout(info.FullMethod)
+
+	if timeout <= 0 {
+		return handler(ctx, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := handler(ctx, req)
+	return resp, deadlineError(ctx, err)
+}
+
+func (s *Server) StreamDeadline(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	timeout := s.config.GetTimeout(info.FullMethod)
+
+	if timeout <= 0 {
+		return handler(srv, stream)
+	}
+
+	ctx, cancel := context.WithTimeout(stream.Context(), timeout)
+	defer cancel()
+
+	return deadlineError(ctx, handler(srv, &serverStream{stream, ctx}))
+}
+
+// server options chaining trace id, access log, recovery and deadline before the given interceptors,
+// pass them to Start instead of grpc.UnaryInterceptor or grpc.StreamInterceptor
+func (s *Server) Interceptors(unary []grpc.UnaryServerInterceptor, stream []grpc.StreamServerInterceptor) []grpc.ServerOption {
+	unary = append([]grpc.UnaryServerInterceptor{TraceServerUnaryInterceptor, s.AccessLog, s.Recovery, s.Deadline}, unary...)
+	stream = append([]grpc.StreamServerInterceptor{TraceServerStreamInterceptor, s.StreamAccessLog, s.StreamRecovery, s.StreamDeadline}, stream...)
+
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(ChainUnaryServer(unary...)),
+		grpc.StreamInterceptor(ChainStreamServer(stream...)),
+	}
+}
+
 func NewServer(c *Config, r Router, l *logger.Logger) *Server {
 	return &Server{config: c, router: r, logger: l}
 }
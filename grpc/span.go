@@ -0,0 +1,332 @@
+package grpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/opay-o2o/golib/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TraceParentKey = "traceparent"
+
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+type spanCtxKey struct{}
+
+type TraceId [16]byte
+
+func (t TraceId) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+type SpanId [8]byte
+
+func (s SpanId) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+type SpanContext struct {
+	TraceId TraceId
+	SpanId  SpanId
+	Sampled bool
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceId != TraceId{} && c.SpanId != SpanId{}
+}
+
+// format as a w3c traceparent header, version 00
+func (c SpanContext) TraceParent() string {
+	flags := "00"
+
+	if c.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + c.TraceId.String() + "-" + c.SpanId.String() + "-" + flags
+}
+
+func ParseTraceParent(header string) (c SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+
+	if _, err := hex.Decode(c.TraceId[:], []byte(parts[1])); err != nil {
+		return
+	}
+
+	if _, err := hex.Decode(c.SpanId[:], []byte(parts[2])); err != nil {
+		return
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+
+	if err != nil {
+		return
+	}
+
+	c.Sampled = flags[0]&1 == 1
+	return c, c.IsValid()
+}
+
+type Span struct {
+	sync.Mutex
+	Name       string
+	Kind       int
+	Context    SpanContext
+	ParentId   SpanId
+	Start      time.Time
+	End        time.Time
+	Code       uint32
+	Message    string
+	Attributes map[string]string
+	tracer     *Tracer
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.Lock()
+	s.Attributes[key] = value
+	s.Unlock()
+}
+
+// record the grpc status of err and hand the span to the exporters
+func (s *Span) Finish(err error) {
+	st := status.Convert(err)
+
+	s.Lock()
+	s.End = time.Now()
+	s.Code, s.Message = uint32(st.Code()), st.Message()
+	s.Unlock()
+
+	if s.Context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanCtxKey{}).(*Span)
+	return span
+}
+
+// service is the name the tracer was created with
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+type Tracer struct {
+	sync.RWMutex
+	service   string
+	exporters []Exporter
+	logger    *logger.Logger
+	queue     chan *Span
+	end       chan bool
+	closed    bool
+}
+
+func NewTracer(service string, l *logger.Logger, exporters ...Exporter) *Tracer {
+	t := &Tracer{
+		service:   service,
+		exporters: exporters,
+		logger:    l,
+		queue:     make(chan *Span, 4096),
+		end:       make(chan bool, 1),
+	}
+
+	go t.run()
+	return t
+}
+
+func (t *Tracer) Service() string {
+	return t.service
+}
+
+func newIds(traceId *TraceId, spanId *SpanId) {
+	if traceId != nil {
+		_, _ = rand.Read(traceId[:])
+	}
+
+	_, _ = rand.Read(spanId[:])
+}
+
+// start a span as the child of parent, or the root of a new sampled trace
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind int, parent SpanContext) (context.Context, *Span) {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]string, 8),
+		tracer:     t,
+	}
+
+	if parent.IsValid() {
+		span.Context.TraceId, span.Context.Sampled, span.ParentId = parent.TraceId, parent.Sampled, parent.SpanId
+		newIds(nil, &span.Context.SpanId)
+	} else {
+		span.Context.Sampled = true
+		newIds(&span.Context.TraceId, &span.Context.SpanId)
+	}
+
+	if traceId := GetCtxTraceId(ctx); traceId != "" {
+		span.Attributes[TraceIdKey] = traceId
+	}
+
+	return context.WithValue(ctx, spanCtxKey{}, span), span
+}
+
+// spans finished after Close are dropped
+func (t *Tracer) enqueue(span *Span) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.closed {
+		return
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+		t.logger.Errorf("span queue is full, span dropped | name: %s", span.Name)
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, 256)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		for _, e := range t.exporters {
+			if err := e.Export(t.service, batch); err != nil {
+				t.logger.Errorf("can't export spans | count: %d | error: %s", len(batch), err)
+			}
+		}
+
+		batch = make([]*Span, 0, 256)
+	}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				flush()
+				t.end <- true
+				return
+			}
+
+			if batch = append(batch, span); len(batch) >= 256 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// flush the queued spans and stop exporting, closing twice is a no-op
+func (t *Tracer) Close() {
+	t.Lock()
+
+	if t.closed {
+		t.Unlock()
+		return
+	}
+
+	t.closed = true
+	close(t.queue)
+	t.Unlock()
+
+	<-t.end
+}
+
+func incomingSpanContext(ctx context.Context) SpanContext {
+	data, _ := metadata.FromIncomingContext(ctx)
+
+	if v := data.Get(TraceParentKey); len(v) > 0 {
+		if parent, ok := ParseTraceParent(v[0]); ok {
+			return parent
+		}
+	}
+
+	return SpanContext{}
+}
+
+func (t *Tracer) startServerSpan(ctx context.Context, method string) (context.Context, *Span) {
+	ctx, span := t.StartSpan(ctx, method, SpanKindServer, incomingSpanContext(ctx))
+	span.Attributes["rpc.system"] = "grpc"
+	span.Attributes["rpc.method"] = method
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		span.Attributes["net.peer.addr"] = p.Addr.String()
+	}
+
+	return ctx, span
+}
+
+func (t *Tracer) startClientSpan(ctx context.Context, method string, target string) (context.Context, *Span) {
+	var parent SpanContext
+
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.Context
+	}
+
+	ctx, span := t.StartSpan(ctx, method, SpanKindClient, parent)
+	span.Attributes["rpc.system"] = "grpc"
+	span.Attributes["rpc.method"] = method
+	span.Attributes["net.peer.addr"] = target
+
+	return metadata.AppendToOutgoingContext(ctx, TraceParentKey, span.Context.TraceParent()), span
+}
+
+func (t *Tracer) ServerUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx, span := t.startServerSpan(ctx, info.FullMethod)
+	defer func() { span.Finish(err) }()
+
+	resp, err = handler(ctx, req)
+	return
+}
+
+func (t *Tracer) ServerStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, span := t.startServerSpan(stream.Context(), info.FullMethod)
+	defer func() { span.Finish(err) }()
+
+	err = handler(srv, &serverStream{stream, ctx})
+	return
+}
+
+func (t *Tracer) ClientUnaryInterceptor(ctx context.Context, method string, req, resp interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) (err error) {
+	ctx, span := t.startClientSpan(ctx, method, conn.Target())
+	defer func() { span.Finish(err) }()
+
+	err = invoker(ctx, method, req, resp, conn, options...)
+	return
+}
+
+// the client stream span ends once the stream is established, not when it's drained
+func (t *Tracer) ClientStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, conn *grpc.ClientConn, method string, streamer grpc.Streamer, options ...grpc.CallOption) (stream grpc.ClientStream, err error) {
+	ctx, span := t.startClientSpan(ctx, method, conn.Target())
+	defer func() { span.Finish(err) }()
+
+	stream, err = streamer(ctx, desc, conn, method, options...)
+	return
+}
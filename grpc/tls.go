@@ -0,0 +1,279 @@
+package grpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+type TlsConfig struct {
+	Enable     bool   `toml:"enable"`
+	CertPath   string `toml:"cert_path"`
+	KeyPath    string `toml:"key_path"`
+	CaPath     string `toml:"ca_path"`
+	ClientAuth bool   `toml:"client_auth"`
+	ServerName string `toml:"server_name"`
+	SkipVerify bool   `toml:"skip_verify"`
+	Reload     int    `toml:"reload"`
+}
+
+type KeepaliveConfig struct {
+	Time                int  `toml:"time"`
+	Timeout             int  `toml:"timeout"`
+	MinTime             int  `toml:"min_time"`
+	MaxConnIdle         int  `toml:"max_conn_idle"`
+	MaxConnAge          int  `toml:"max_conn_age"`
+	PermitWithoutStream bool `toml:"permit_without_stream"`
+}
+
+type ClientConfig struct {
+	Tls            *TlsConfig       `toml:"tls"`
+	Keepalive      *KeepaliveConfig `toml:"keepalive"`
+	MaxRecvMsgSize int              `toml:"max_recv_msg_size"`
+	MaxSendMsgSize int              `toml:"max_send_msg_size"`
+}
+
+// reload the key pair from disk when the files change, checked at most every interval
+type certReloader struct {
+	sync.Mutex
+	certPath  string
+	keyPath   string
+	interval  time.Duration
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(c *TlsConfig) (*certReloader, error) {
+	r := &certReloader{certPath: c.CertPath, keyPath: c.KeyPath, interval: time.Duration(c.Reload) * time.Second}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(path)
+
+		if err != nil {
+			return latest, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.modified()
+
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+
+	if err != nil {
+		return err
+	}
+
+	r.cert, r.modTime, r.checkedAt = &cert, modTime, time.Now()
+	return nil
+}
+
+func (r *certReloader) get() *tls.Certificate {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.interval <= 0 || time.Since(r.checkedAt) < r.interval {
+		return r.cert
+	}
+
+	r.checkedAt = time.Now()
+
+	// keep serving the old pair if the new files are missing or only half written
+	if modTime, err := r.modified(); err == nil && modTime.After(r.modTime) {
+		_ = r.load()
+	}
+
+	return r.cert
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate in " + path)
+	}
+
+	return pool, nil
+}
+
+func (c *TlsConfig) ServerTls() (*tls.Config, error) {
+	reloader, err := newCertReloader(c)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return reloader.get(), nil
+		},
+	}
+
+	if c.CaPath != "" {
+		if config.ClientCAs, err = loadCertPool(c.CaPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ClientAuth {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+func (c *TlsConfig) ClientTls() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.SkipVerify}
+
+	if c.CaPath != "" {
+		pool, err := loadCertPool(c.CaPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = pool
+	}
+
+	if c.CertPath != "" && c.KeyPath != "" {
+		reloader, err := newCertReloader(c)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.get(), nil
+		}
+	}
+
+	return config, nil
+}
+
+func (c *Config) ServerOptions() ([]grpc.ServerOption, error) {
+	var options []grpc.ServerOption
+
+	if c.Tls != nil && c.Tls.Enable {
+		config, err := c.Tls.ServerTls()
+
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+
+	if k := c.Keepalive; k != nil {
+		options = append(options,
+			grpc.KeepaliveParams(keepalive.ServerParameters{
+				MaxConnectionIdle: time.Duration(k.MaxConnIdle) * time.Second,
+				MaxConnectionAge:  time.Duration(k.MaxConnAge) * time.Second,
+				Time:              time.Duration(k.Time) * time.Second,
+				Timeout:           time.Duration(k.Timeout) * time.Second,
+			}),
+			grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+				MinTime:             time.Duration(k.MinTime) * time.Second,
+				PermitWithoutStream: k.PermitWithoutStream,
+			}),
+		)
+	}
+
+	if c.MaxRecvMsgSize > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(c.MaxRecvMsgSize))
+	}
+
+	if c.MaxSendMsgSize > 0 {
+		options = append(options, grpc.MaxSendMsgSize(c.MaxSendMsgSize))
+	}
+
+	return options, nil
+}
+
+func (c *ClientConfig) DialOptions() ([]grpc.DialOption, error) {
+	var options []grpc.DialOption
+
+	if c.Tls != nil && c.Tls.Enable {
+		config, err := c.Tls.ClientTls()
+
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	} else {
+		options = append(options, grpc.WithInsecure())
+	}
+
+	if k := c.Keepalive; k != nil {
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Duration(k.Time) * time.Second,
+			Timeout:             time.Duration(k.Timeout) * time.Second,
+			PermitWithoutStream: k.PermitWithoutStream,
+		}))
+	}
+
+	var callOptions []grpc.CallOption
+
+	if c.MaxRecvMsgSize > 0 {
+		callOptions = append(callOptions, grpc.MaxCallRecvMsgSize(c.MaxRecvMsgSize))
+	}
+
+	if c.MaxSendMsgSize > 0 {
+		callOptions = append(callOptions, grpc.MaxCallSendMsgSize(c.MaxSendMsgSize))
+	}
+
+	if len(callOptions) > 0 {
+		options = append(options, grpc.WithDefaultCallOptions(callOptions...))
+	}
+
+	return options, nil
+}
+
+// build a pool dialer from the client config, extra options are appended to the ones of the config
+func NewDialer(c *ClientConfig, options ...grpc.DialOption) (Dialer, error) {
+	configOptions, err := c.DialOptions()
+
+	if err != nil {
+		return nil, err
+	}
+
+	options = append(configOptions, options...)
+
+	return func(addr string) (*grpc.ClientConn, error) {
+		return grpc.Dial(addr, options...)
+	}, nil
+}
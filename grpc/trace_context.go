@@ -11,6 +11,8 @@ import (
 	"time"
 )
 
+const TraceIdKey = "trace_id"
+
 var serialNumber uint64
 var localIp string
 
@@ -38,10 +40,13 @@ func GenTraceId() string {
 	return fmt.Sprintf("%02x%02x%02x%02x%013d%04d", params...)
 }
 
+// carry the trace id of parent, or a new one, in the outgoing metadata of a child of parent
 func NewTraceCtx(parent context.Context) context.Context {
 	var trackId string
 
-	if parent != nil {
+	if parent == nil {
+		parent = context.Background()
+	} else {
 		trackId = GetCtxTraceId(parent)
 	}
 
@@ -49,27 +54,25 @@ func NewTraceCtx(parent context.Context) context.Context {
 		trackId = GenTraceId()
 	}
 
-	return metadata.NewOutgoingContext(
-		context.Background(),
-		metadata.New(map[string]string{"trace_id": trackId}),
-	)
+	data, _ := metadata.FromOutgoingContext(parent)
+	data = metadata.Join(data, nil)
+	data.Set(TraceIdKey, trackId)
+
+	return metadata.NewOutgoingContext(parent, data)
 }
 
+// read the trace id from the incoming metadata, falling back to the outgoing one
 func GetCtxTraceId(ctx context.Context) (trackId string) {
-	data, ok := metadata.FromIncomingContext(ctx)
-
-	if !ok {
-		return
-	}
-
-	v, ok := data["trace_id"]
-
-	if !ok || len(v) < 1 {
-		return
+	if data, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := data.Get(TraceIdKey); len(v) > 0 && v[0] != "" {
+			return v[0]
+		}
 	}
 
-	if v[0] != "" {
-		trackId = v[0]
+	if data, ok := metadata.FromOutgoingContext(ctx); ok {
+		if v := data.Get(TraceIdKey); len(v) > 0 && v[0] != "" {
+			return v[0]
+		}
 	}
 
 	return
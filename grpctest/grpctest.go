@@ -0,0 +1,98 @@
+package grpctest
+
+import (
+	"context"
+	"github.com/opay-o2o/golib/grpc"
+	"github.com/opay-o2o/golib/logger"
+	ggrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+)
+
+const (
+	BufSize = 1024 * 1024
+	// the address to pass to the pool, any other works as well since all of them reach the same listener
+	Addr = "bufconn"
+)
+
+// a grpc.Server serving a router over an in-memory listener, no port is bound
+type Server struct {
+	*grpc.Server
+	listener *bufconn.Listener
+}
+
+func NewServer(c *grpc.Config, r grpc.Router, l *logger.Logger, options ...ggrpc.ServerOption) (*Server, error) {
+	if c == nil {
+		c = &grpc.Config{}
+	}
+
+	s := &Server{Server: grpc.NewServer(c, r, l), listener: bufconn.Listen(BufSize)}
+
+	if err := s.Serve(s.listener, options...); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Server) DialContext(ctx context.Context, options ...ggrpc.DialOption) (*ggrpc.ClientConn, error) {
+	options = append([]ggrpc.DialOption{
+		ggrpc.WithInsecure(),
+		ggrpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return s.listener.Dial()
+		}),
+	}, options...)
+
+	return ggrpc.DialContext(ctx, Addr, options...)
+}
+
+func (s *Server) Dial(options ...ggrpc.DialOption) (*ggrpc.ClientConn, error) {
+	return s.DialContext(context.Background(), options...)
+}
+
+// a dialer for grpc.NewPool, every address is connected to the in-memory server
+func (s *Server) Dialer(options ...ggrpc.DialOption) grpc.Dialer {
+	return func(addr string) (*ggrpc.ClientConn, error) {
+		return s.Dial(options...)
+	}
+}
+
+func (s *Server) Close() {
+	s.Stop()
+	_ = s.listener.Close()
+}
+
+// a context as seen by a server handler, carrying the incoming metadata of kv pairs
+func IncomingContext(ctx context.Context, kv ...string) context.Context {
+	data, _ := metadata.FromIncomingContext(ctx)
+	return metadata.NewIncomingContext(ctx, metadata.Join(data, metadata.Pairs(kv...)))
+}
+
+func WithTraceId(ctx context.Context, traceId string) context.Context {
+	return IncomingContext(ctx, grpc.TraceIdKey, traceId)
+}
+
+type fakeAddr struct {
+	network string
+	addr    string
+}
+
+func (a fakeAddr) Network() string {
+	return a.network
+}
+
+func (a fakeAddr) String() string {
+	return a.addr
+}
+
+// a context with a fake peer at addr, like "10.0.0.1:5000"
+func WithPeer(ctx context.Context, addr string) context.Context {
+	return peer.NewContext(ctx, &peer.Peer{Addr: fakeAddr{"tcp", addr}})
+}
+
+// call a unary server interceptor directly, handler plays the service method
+func CallUnary(ctx context.Context, interceptor ggrpc.UnaryServerInterceptor, method string, req interface{}, handler ggrpc.UnaryHandler) (interface{}, error) {
+	return interceptor(ctx, req, &ggrpc.UnaryServerInfo{FullMethod: method}, handler)
+}
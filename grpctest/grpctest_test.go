@@ -0,0 +1,132 @@
+package grpctest_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/opay-o2o/golib/grpc"
+	"github.com/opay-o2o/golib/grpctest"
+	"github.com/opay-o2o/golib/logger"
+	ggrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+type emptyRouter struct{}
+
+func (emptyRouter) RegGrpcService(*ggrpc.Server) {}
+
+type exportedSpan struct {
+	TraceId      string `json:"traceId"`
+	SpanId       string `json:"spanId"`
+	ParentSpanId string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+}
+
+type exportRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []*exportedSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func newLogger(t *testing.T) (*logger.Logger, func()) {
+	dir, err := ioutil.TempDir("", "grpctest")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := logger.DefaultConfig()
+	c.Dir, c.Terminal = dir, false
+	l, err := logger.NewLogger(c)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l, func() {
+		l.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// a health check through the in-memory server exports a client and a server span of one trace to the collector
+func TestServerTracing(t *testing.T) {
+	l, cleanup := newLogger(t)
+	defer cleanup()
+
+	spans := make(chan *exportedSpan, 16)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := &exportRequest{}
+
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for _, resource := range body.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				for _, span := range scope.Spans {
+					spans <- span
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	tracer := grpc.NewTracer("grpctest", l, grpc.NewOtlpExporter(&grpc.OtlpConfig{Endpoint: collector.URL}))
+
+	server, err := grpctest.NewServer(nil, emptyRouter{}, l, ggrpc.UnaryInterceptor(tracer.ServerUnaryInterceptor))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	conn, err := server.Dial(ggrpc.WithUnaryInterceptor(tracer.ClientUnaryInterceptor))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+
+	if err != nil || resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Fatalf("health check: %v %v", resp, err)
+	}
+
+	tracer.Close()
+	close(spans)
+
+	byKind := map[int]*exportedSpan{}
+
+	for span := range spans {
+		byKind[span.Kind] = span
+	}
+
+	client, serverSpan := byKind[grpc.SpanKindClient], byKind[grpc.SpanKindServer]
+
+	if client == nil || serverSpan == nil {
+		t.Fatalf("want a client and a server span, got %v", byKind)
+	}
+
+	if client.TraceId != serverSpan.TraceId || serverSpan.ParentSpanId != client.SpanId {
+		t.Fatalf("server span %+v isn't a child of client span %+v", serverSpan, client)
+	}
+
+	if serverSpan.Name != "/grpc.health.v1.Health/Check" {
+		t.Fatalf("unexpected server span name %s", serverSpan.Name)
+	}
+}
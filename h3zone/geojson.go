@@ -0,0 +1,230 @@
+package h3zone
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opay-o2o/golib/tude"
+	"github.com/uber/h3-go"
+)
+
+const (
+	TypeFeature           = "Feature"
+	TypeFeatureCollection = "FeatureCollection"
+	TypePolygon           = "Polygon"
+	TypeMultiPolygon      = "MultiPolygon"
+)
+
+var ErrGeoJson = errors.New("unsupported geojson")
+
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type Feature struct {
+	Type       string                 `json:"type"`
+	Geometry   *Geometry              `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+}
+
+func LoadHashes(hashes []string) []*Zone {
+	zones := make([]*Zone, 0, len(hashes))
+
+	for _, hash := range hashes {
+		zones = append(zones, LoadHash(hash))
+	}
+
+	return zones
+}
+
+// vertices of the cell counterclockwise, 6 for hexagons and 5 or more for pentagons
+func (z *Zone) Boundary() []*tude.Point {
+	boundary := h3.ToGeoBoundary(z.index())
+	points := make([]*tude.Point, 0, len(boundary))
+
+	for _, v := range boundary {
+		points = append(points, tude.NewPoint(v.Longitude, v.Latitude))
+	}
+
+	return points
+}
+
+// a closed ring of [lng, lat] positions
+func ring(points []*tude.Point) [][2]float64 {
+	positions := make([][2]float64, 0, len(points)+1)
+
+	for _, p := range points {
+		positions = append(positions, [2]float64{p.Lng(), p.Lat()})
+	}
+
+	if len(points) > 0 {
+		positions = append(positions, positions[0])
+	}
+
+	return positions
+}
+
+func NewPolygonFeature(polygon *tude.Polygon, properties map[string]interface{}) *Feature {
+	coordinates, _ := json.Marshal([][][2]float64{ring(polygon.Points())})
+
+	if properties == nil {
+		properties = map[string]interface{}{}
+	}
+
+	return &Feature{Type: TypeFeature, Geometry: &Geometry{TypePolygon, coordinates}, Properties: properties}
+}
+
+// the cell boundary as a polygon, with the hash and level as properties
+func (z *Zone) Feature() *Feature {
+	return NewPolygonFeature(tude.NewPolygon(z.Boundary()), map[string]interface{}{"hash": z.Hash, "level": z.Level})
+}
+
+func NewFeatureCollection(zones []*Zone) *FeatureCollection {
+	fc := &FeatureCollection{Type: TypeFeatureCollection, Features: make([]*Feature, 0, len(zones))}
+
+	for _, z := range zones {
+		fc.Features = append(fc.Features, z.Feature())
+	}
+
+	return fc
+}
+
+func polygonOf(positions [][2]float64) *tude.Polygon {
+	// the closing position repeats the first one
+	if n := len(positions); n > 1 && positions[0] == positions[n-1] {
+		positions = positions[:n-1]
+	}
+
+	polygon := tude.NewPolygon(make([]*tude.Point, 0, len(positions)))
+
+	for _, p := range positions {
+		polygon.Add(tude.NewPoint(p[0], p[1]))
+	}
+
+	return polygon
+}
+
+// exterior rings of a Polygon or MultiPolygon geometry, holes are ignored
+func (g *Geometry) Polygons() ([]*tude.Polygon, error) {
+	switch g.Type {
+	case TypePolygon:
+		var rings [][][2]float64
+
+		if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+			return nil, err
+		}
+
+		if len(rings) == 0 {
+			return nil, nil
+		}
+
+		return []*tude.Polygon{polygonOf(rings[0])}, nil
+	case TypeMultiPolygon:
+		var polygons [][][][2]float64
+
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+
+		out := make([]*tude.Polygon, 0, len(polygons))
+
+		for _, rings := range polygons {
+			if len(rings) > 0 {
+				out = append(out, polygonOf(rings[0]))
+			}
+		}
+
+		return out, nil
+	default:
+		return nil, fmt.Errorf("%s: geometry %s", ErrGeoJson, g.Type)
+	}
+}
+
+// the zone of a feature written by Zone.Feature, nil for other features
+func (f *Feature) Zone() *Zone {
+	hash, ok := f.Properties["hash"].(string)
+
+	if !ok || !h3.IsValid(h3.FromString(hash)) {
+		return nil
+	}
+
+	return LoadHash(hash)
+}
+
+func (fc *FeatureCollection) Zones() []*Zone {
+	zones := make([]*Zone, 0, len(fc.Features))
+
+	for _, f := range fc.Features {
+		if z := f.Zone(); z != nil {
+			zones = append(zones, z)
+		}
+	}
+
+	return zones
+}
+
+func (fc *FeatureCollection) Polygons() ([]*tude.Polygon, error) {
+	var polygons []*tude.Polygon
+
+	for _, f := range fc.Features {
+		if f.Geometry == nil {
+			continue
+		}
+
+		p, err := f.Geometry.Polygons()
+
+		if err != nil {
+			return nil, err
+		}
+
+		polygons = append(polygons, p...)
+	}
+
+	return polygons, nil
+}
+
+// decode a FeatureCollection, a single Feature or a bare geometry, the latter two are wrapped in a collection
+func DecodeGeoJson(data []byte) (*FeatureCollection, error) {
+	var head struct {
+		Type string `json:"type"`
+	}
+
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, err
+	}
+
+	fc := &FeatureCollection{Type: TypeFeatureCollection}
+
+	switch head.Type {
+	case TypeFeatureCollection:
+		if err := json.Unmarshal(data, fc); err != nil {
+			return nil, err
+		}
+	case TypeFeature:
+		f := &Feature{}
+
+		if err := json.Unmarshal(data, f); err != nil {
+			return nil, err
+		}
+
+		fc.Features = []*Feature{f}
+	case TypePolygon, TypeMultiPolygon:
+		g := &Geometry{}
+
+		if err := json.Unmarshal(data, g); err != nil {
+			return nil, err
+		}
+
+		fc.Features = []*Feature{{Type: TypeFeature, Geometry: g, Properties: map[string]interface{}{}}}
+	default:
+		return nil, fmt.Errorf("%s: type %s", ErrGeoJson, head.Type)
+	}
+
+	return fc, nil
+}
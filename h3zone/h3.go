@@ -1,10 +1,24 @@
 package h3zone
 
-import "github.com/uber/h3-go"
+import (
+	"errors"
+	"github.com/opay-o2o/golib/tude"
+	"github.com/uber/h3-go"
+	"math"
+)
 
 const (
 	MinLevel = 0
 	MaxLevel = 15
+	// the farthest grid distance Distance searches for
+	MaxDistance = 200
+	// the deepest level gap Children expands, each level multiplies the cells by 7
+	MaxChildrenGap = 6
+)
+
+var (
+	ErrLevel   = errors.New("h3 level out of range")
+	ErrPolygon = errors.New("polygon needs at least 3 points")
 )
 
 var edgeLengthKm = []float64{
@@ -22,12 +36,29 @@ type Zone struct {
 	Hash   string
 }
 
-func LoadHash(hash string) *Zone {
-	index := h3.FromString(hash)
+func loadIndex(index h3.H3Index) *Zone {
 	level, center := h3.Resolution(index), h3.ToGeo(index)
 	length := edgeLengthKm[level]
 
-	return &Zone{Lng: center.Longitude, Lat: center.Latitude, Level: level, Length: length, Hash: hash}
+	return &Zone{Lng: center.Longitude, Lat: center.Latitude, Level: level, Length: length, Hash: h3.ToString(index)}
+}
+
+func loadIndexes(indexes []h3.H3Index) []*Zone {
+	zones := make([]*Zone, 0, len(indexes))
+
+	for _, index := range indexes {
+		zones = append(zones, loadIndex(index))
+	}
+
+	return zones
+}
+
+// Hash is kept as given instead of being rebuilt from the index
+func LoadHash(hash string) *Zone {
+	z := loadIndex(h3.FromString(hash))
+	z.Hash = hash
+
+	return z
 }
 
 func LoadGeo(lng, lat float64, level int) *Zone {
@@ -35,9 +66,147 @@ func LoadGeo(lng, lat float64, level int) *Zone {
 		return nil
 	}
 
-	index := h3.FromGeo(h3.GeoCoord{Latitude: lat, Longitude: lng}, level)
-	center, hash := h3.ToGeo(index), h3.ToString(index)
-	length := edgeLengthKm[level]
+	return loadIndex(h3.FromGeo(h3.GeoCoord{Latitude: lat, Longitude: lng}, level))
+}
+
+func (z *Zone) index() h3.H3Index {
+	return h3.FromString(z.Hash)
+}
+
+// zones within k cells, the zone itself included
+func (z *Zone) KRing(k int) []*Zone {
+	return loadIndexes(h3.KRing(z.index(), k))
+}
+
+// zones exactly k cells away, nil for a negative k
+func (z *Zone) HexRing(k int) []*Zone {
+	if k < 0 {
+		return nil
+	}
+
+	if ring, err := h3.HexRing(z.index(), k); err == nil {
+		return loadIndexes(ring)
+	}
+
+	// the fast path fails around pentagons, fall back to the slower distances
+	return loadIndexes(h3.KRingDistances(z.index(), k)[k])
+}
+
+func (z *Zone) IsNeighbor(other *Zone) bool {
+	return h3.AreNeighbors(z.index(), other.index())
+}
+
+// grid distance in cells, -1 if the zones are of different levels or farther than MaxDistance
+func (z *Zone) Distance(other *Zone) int {
+	if z.Level != other.Level {
+		return -1
+	}
+
+	if z.Hash == other.Hash {
+		return 0
+	}
+
+	// estimate the bound from the distance of the centers, cells are about √3 edges apart
+	meters := tude.Distance(tude.NewPoint(z.Lng, z.Lat), tude.NewPoint(other.Lng, other.Lat))
+	bound := int(2*meters/(math.Sqrt(3)*z.Length*1000)) + 2
+
+	if bound > MaxDistance {
+		bound = MaxDistance
+	}
+
+	target := other.index()
+
+	for k, ring := range h3.KRingDistances(z.index(), bound) {
+		for _, index := range ring {
+			if index == target {
+				return k
+			}
+		}
+	}
+
+	return -1
+}
+
+func (z *Zone) Parent(level int) *Zone {
+	if level < MinLevel || level > z.Level {
+		return nil
+	}
+
+	return loadIndex(h3.ToParent(z.index(), level))
+}
+
+// nil when level is more than MaxChildrenGap below the zone, about 117k zones at most
+func (z *Zone) Children(level int) []*Zone {
+	if level < z.Level || level > MaxLevel || level-z.Level > MaxChildrenGap {
+		return nil
+	}
+
+	return loadIndexes(h3.ToChildren(z.index(), level))
+}
+
+// zones of level whose centers are inside the polygon, ErrPolygon for less than 3 points
+func Polyfill(polygon *tude.Polygon, level int) ([]*Zone, error) {
+	if level < MinLevel || level > MaxLevel {
+		return nil, ErrLevel
+	}
+
+	if !polygon.IsClosed() {
+		return nil, ErrPolygon
+	}
+
+	fence := make([]h3.GeoCoord, 0, len(polygon.Points()))
+
+	for _, p := range polygon.Points() {
+		fence = append(fence, h3.GeoCoord{Latitude: p.Lat(), Longitude: p.Lng()})
+	}
+
+	return loadIndexes(h3.Polyfill(h3.GeoPolygon{Geofence: fence}, level)), nil
+}
+
+func indexes(zones []*Zone) []h3.H3Index {
+	out := make([]h3.H3Index, 0, len(zones))
+
+	for _, z := range zones {
+		out = append(out, z.index())
+	}
+
+	return out
+}
+
+// merge complete sets of children into their parents, zones must be of the same level and distinct
+func Compact(zones []*Zone) []*Zone {
+	if len(zones) == 0 {
+		return nil
+	}
+
+	return loadIndexes(h3.Compact(indexes(zones)))
+}
+
+// expand zones of mixed levels to level, the reverse of Compact
+func Uncompact(zones []*Zone, level int) ([]*Zone, error) {
+	if level < MinLevel || level > MaxLevel {
+		return nil, ErrLevel
+	}
+
+	if len(zones) == 0 {
+		return nil, nil
+	}
+
+	out, err := h3.Uncompact(indexes(zones), level)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return loadIndexes(out), nil
+}
+
+func Hashes(zones []*Zone) []string {
+	hashes := make([]string, 0, len(zones))
+
+	for _, z := range zones {
+		hashes = append(hashes, z.Hash)
+	}
 
-	return &Zone{Lng: center.Longitude, Lat: center.Latitude, Level: level, Length: length, Hash: hash}
+	return hashes
 }
@@ -0,0 +1,247 @@
+package h3zone
+
+import (
+	"container/list"
+	"github.com/opay-o2o/golib/tude"
+	"github.com/uber/h3-go"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Span is the longest window in seconds, counts are kept in buckets of Bucket seconds,
+// MaxCells bounds the tracked cells, the least recently hit one is evicted beyond it
+type HeatConfig struct {
+	Level    int `toml:"level"`
+	Span     int `toml:"span"`
+	Bucket   int `toml:"bucket"`
+	MaxCells int `toml:"max_cells"`
+}
+
+type HeatCell struct {
+	Hash  string  `json:"hash"`
+	Count float64 `json:"count"`
+}
+
+type heatCell struct {
+	counts  []int64
+	buckets []int64
+	lastHit int64
+	element *list.Element
+}
+
+// counts of points per cell over sliding windows, like the supply of drivers or the demand of orders
+type Heat struct {
+	sync.RWMutex
+	config *HeatConfig
+	size   int64
+	cells  map[h3.H3Index]*heatCell
+	// indexes of the cells, the most recently hit at the front
+	recent *list.List
+}
+
+func NewHeat(c *HeatConfig) (*Heat, error) {
+	if c.Level < MinLevel || c.Level > MaxLevel {
+		return nil, ErrLevel
+	}
+
+	if c.Span <= 0 {
+		c.Span = 900
+	}
+
+	if c.Bucket <= 0 {
+		c.Bucket = 10
+	}
+
+	if c.MaxCells <= 0 {
+		c.MaxCells = 100000
+	}
+
+	return &Heat{
+		config: c,
+		size:   int64((c.Span + c.Bucket - 1) / c.Bucket),
+		cells:  make(map[h3.H3Index]*heatCell, 1024),
+		recent: list.New(),
+	}, nil
+}
+
+func (h *Heat) bucket(timestamp int64) int64 {
+	return timestamp / int64(h.config.Bucket)
+}
+
+func (h *Heat) expired(cell *heatCell, now int64) bool {
+	return cell.lastHit <= now-h.size
+}
+
+// drop the cells without any count in the span
+func (h *Heat) prune(now int64) {
+	for index, cell := range h.cells {
+		if h.expired(cell, now) {
+			h.recent.Remove(cell.element)
+			delete(h.cells, index)
+		}
+	}
+}
+
+func (h *Heat) evictOldest() {
+	if e := h.recent.Back(); e != nil {
+		delete(h.cells, h.recent.Remove(e).(h3.H3Index))
+	}
+}
+
+// count a point at its unix timestamp in seconds, points older than the span are ignored
+func (h *Heat) Add(p *tude.TimePoint) {
+	now, bucket := h.bucket(time.Now().Unix()), h.bucket(p.GetTimestamp())
+
+	if bucket <= now-h.size || bucket > now {
+		return
+	}
+
+	point := p.GetPoint()
+	index := h3.FromGeo(h3.GeoCoord{Latitude: point.Lat(), Longitude: point.Lng()}, h.config.Level)
+
+	h.Lock()
+	defer h.Unlock()
+
+	cell, ok := h.cells[index]
+
+	if ok {
+		h.recent.MoveToFront(cell.element)
+	} else {
+		if len(h.cells) >= h.config.MaxCells {
+			h.evictOldest()
+		}
+
+		cell = &heatCell{counts: make([]int64, h.size), buckets: make([]int64, h.size)}
+		cell.element = h.recent.PushFront(index)
+		h.cells[index] = cell
+	}
+
+	slot := bucket % h.size
+
+	if cell.buckets[slot] != bucket {
+		cell.buckets[slot], cell.counts[slot] = bucket, 0
+	}
+
+	cell.counts[slot]++
+
+	if bucket > cell.lastHit {
+		cell.lastHit = bucket
+	}
+}
+
+// sum of the buckets of the last window seconds
+func (h *Heat) count(index h3.H3Index, now, window int64) int64 {
+	cell, ok := h.cells[index]
+
+	if !ok {
+		return 0
+	}
+
+	var total int64
+
+	for slot, bucket := range cell.buckets {
+		if bucket > now-window && bucket <= now {
+			total += cell.counts[slot]
+		}
+	}
+
+	return total
+}
+
+func (h *Heat) window(seconds int) int64 {
+	window := int64((seconds + h.config.Bucket - 1) / h.config.Bucket)
+
+	if window > h.size || window <= 0 {
+		window = h.size
+	}
+
+	return window
+}
+
+func (h *Heat) Count(hash string, window int) int64 {
+	now := h.bucket(time.Now().Unix())
+
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.count(h3.FromString(hash), now, h.window(window))
+}
+
+// counts of the k-ring around index weighted by 1/(distance+1), normalized by the total weight
+func (h *Heat) smoothed(index h3.H3Index, now, window int64, k int) float64 {
+	if k <= 0 {
+		return float64(h.count(index, now, window))
+	}
+
+	var sum, weights float64
+
+	for distance, ring := range h3.KRingDistances(index, k) {
+		weight := 1 / float64(distance+1)
+
+		for _, neighbor := range ring {
+			sum += weight * float64(h.count(neighbor, now, window))
+			weights += weight
+		}
+	}
+
+	return sum / weights
+}
+
+func (h *Heat) Smoothed(hash string, window, k int) float64 {
+	now := h.bucket(time.Now().Unix())
+
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.smoothed(h3.FromString(hash), now, h.window(window), k)
+}
+
+// the n hottest cells over the window, smoothed over the k-ring when k > 0
+func (h *Heat) Top(n, window, k int) []*HeatCell {
+	now := h.bucket(time.Now().Unix())
+
+	h.RLock()
+	w := h.window(window)
+	cells := make([]*HeatCell, 0, len(h.cells))
+
+	for index := range h.cells {
+		if count := h.smoothed(index, now, w, k); count > 0 {
+			cells = append(cells, &HeatCell{h3.ToString(index), count})
+		}
+	}
+
+	h.RUnlock()
+
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Count != cells[j].Count {
+			return cells[i].Count > cells[j].Count
+		}
+
+		return cells[i].Hash < cells[j].Hash
+	})
+
+	if n > 0 && len(cells) > n {
+		cells = cells[:n]
+	}
+
+	return cells
+}
+
+// drop expired cells, Add only evicts the least recently hit cell beyond MaxCells,
+// so call it periodically to free the cells that stopped getting points
+func (h *Heat) Prune() {
+	now := h.bucket(time.Now().Unix())
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.prune(now)
+}
+
+func (h *Heat) Len() int {
+	h.RLock()
+	defer h.RUnlock()
+
+	return len(h.cells)
+}
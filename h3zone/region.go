@@ -0,0 +1,260 @@
+package h3zone
+
+import (
+	"encoding/gob"
+	"github.com/opay-o2o/golib/tude"
+	"github.com/uber/h3-go"
+	"io"
+	"math"
+	"sort"
+	"sync"
+)
+
+type regionCell struct {
+	Region string
+	// the cell is crossed by the border of the region, points in it need the exact polygon check
+	Border bool
+}
+
+// map h3 cells of one level to the regions covering them, so a point is located by its cell
+// instead of testing every polygon
+type RegionIndex struct {
+	sync.RWMutex
+	level   int
+	regions map[string]*tude.Polygon
+	cells   map[h3.H3Index][]regionCell
+	covers  map[string][]h3.H3Index
+}
+
+func NewRegionIndex(level int) (*RegionIndex, error) {
+	if level < MinLevel || level > MaxLevel {
+		return nil, ErrLevel
+	}
+
+	return &RegionIndex{
+		level:   level,
+		regions: make(map[string]*tude.Polygon, 16),
+		cells:   make(map[h3.H3Index][]regionCell, 1024),
+		covers:  make(map[string][]h3.H3Index, 16),
+	}, nil
+}
+
+func (x *RegionIndex) Level() int {
+	return x.level
+}
+
+// cells crossed by the polygon edges plus their neighbors, sampled at a third of the cell edge
+func (x *RegionIndex) borderCells(polygon *tude.Polygon) map[h3.H3Index]bool {
+	points := polygon.Points()
+	step := edgeLengthKm[x.level] / 111.32 / 3
+	crossed := make(map[h3.H3Index]bool, 256)
+
+	for i := range points {
+		start, end := points[i], points[(i+1)%len(points)]
+		dLng, dLat := end.Lng()-start.Lng(), end.Lat()-start.Lat()
+		n := int(math.Ceil(math.Max(math.Abs(dLng), math.Abs(dLat))/step)) + 1
+
+		for j := 0; j <= n; j++ {
+			t := float64(j) / float64(n)
+			geo := h3.GeoCoord{Latitude: start.Lat() + dLat*t, Longitude: start.Lng() + dLng*t}
+			crossed[h3.FromGeo(geo, x.level)] = true
+		}
+	}
+
+	border := make(map[h3.H3Index]bool, len(crossed)*3)
+
+	for cell := range crossed {
+		for _, neighbor := range h3.KRing(cell, 1) {
+			border[neighbor] = true
+		}
+	}
+
+	return border
+}
+
+// cells outside the border whose centers are inside are wholly inside the polygon
+func (x *RegionIndex) cover(polygon *tude.Polygon) map[h3.H3Index]bool {
+	cover := x.borderCells(polygon)
+	fence := make([]h3.GeoCoord, 0, len(polygon.Points()))
+
+	for _, p := range polygon.Points() {
+		fence = append(fence, h3.GeoCoord{Latitude: p.Lat(), Longitude: p.Lng()})
+	}
+
+	for _, cell := range h3.Polyfill(h3.GeoPolygon{Geofence: fence}, x.level) {
+		if _, ok := cover[cell]; !ok {
+			cover[cell] = false
+		}
+	}
+
+	return cover
+}
+
+// add or replace the region id, ErrPolygon for less than 3 points
+func (x *RegionIndex) Add(id string, polygon *tude.Polygon) error {
+	if !polygon.IsClosed() {
+		return ErrPolygon
+	}
+
+	cover := x.cover(polygon)
+
+	x.Lock()
+	defer x.Unlock()
+
+	x.remove(id)
+	x.regions[id] = polygon
+	cells := make([]h3.H3Index, 0, len(cover))
+
+	for cell, border := range cover {
+		x.cells[cell] = append(x.cells[cell], regionCell{id, border})
+		cells = append(cells, cell)
+	}
+
+	x.covers[id] = cells
+	return nil
+}
+
+func (x *RegionIndex) remove(id string) {
+	for _, cell := range x.covers[id] {
+		entries := x.cells[cell][:0]
+
+		for _, e := range x.cells[cell] {
+			if e.Region != id {
+				entries = append(entries, e)
+			}
+		}
+
+		if len(entries) == 0 {
+			delete(x.cells, cell)
+		} else {
+			x.cells[cell] = entries
+		}
+	}
+
+	delete(x.regions, id)
+	delete(x.covers, id)
+}
+
+func (x *RegionIndex) Remove(id string) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.remove(id)
+}
+
+// ids of the regions containing the point, sorted
+func (x *RegionIndex) Locate(lng, lat float64) []string {
+	cell := h3.FromGeo(h3.GeoCoord{Latitude: lat, Longitude: lng}, x.level)
+
+	x.RLock()
+	defer x.RUnlock()
+
+	var ids []string
+	var point *tude.Point
+
+	for _, e := range x.cells[cell] {
+		if e.Border {
+			if point == nil {
+				point = tude.NewPoint(lng, lat)
+			}
+
+			if !x.regions[e.Region].Contains(point) {
+				continue
+			}
+		}
+
+		ids = append(ids, e.Region)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+func (x *RegionIndex) Regions() []string {
+	x.RLock()
+	defer x.RUnlock()
+
+	ids := make([]string, 0, len(x.regions))
+
+	for id := range x.regions {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+func (x *RegionIndex) Cells() int {
+	x.RLock()
+	defer x.RUnlock()
+
+	return len(x.cells)
+}
+
+type regionSnapshot struct {
+	Level   int
+	Regions map[string][][2]float64
+	Cells   map[uint64][]regionCell
+}
+
+// write the precomputed index, read it back with DecodeRegionIndex
+func (x *RegionIndex) Encode(w io.Writer) error {
+	x.RLock()
+	defer x.RUnlock()
+
+	snapshot := &regionSnapshot{
+		Level:   x.level,
+		Regions: make(map[string][][2]float64, len(x.regions)),
+		Cells:   make(map[uint64][]regionCell, len(x.cells)),
+	}
+
+	for id, polygon := range x.regions {
+		points := make([][2]float64, 0, len(polygon.Points()))
+
+		for _, p := range polygon.Points() {
+			points = append(points, [2]float64{p.Lng(), p.Lat()})
+		}
+
+		snapshot.Regions[id] = points
+	}
+
+	for cell, entries := range x.cells {
+		snapshot.Cells[uint64(cell)] = entries
+	}
+
+	return gob.NewEncoder(w).Encode(snapshot)
+}
+
+func DecodeRegionIndex(r io.Reader) (*RegionIndex, error) {
+	snapshot := &regionSnapshot{}
+
+	if err := gob.NewDecoder(r).Decode(snapshot); err != nil {
+		return nil, err
+	}
+
+	x, err := NewRegionIndex(snapshot.Level)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for id, points := range snapshot.Regions {
+		polygon := tude.NewPolygon(make([]*tude.Point, 0, len(points)))
+
+		for _, p := range points {
+			polygon.Add(tude.NewPoint(p[0], p[1]))
+		}
+
+		x.regions[id] = polygon
+	}
+
+	for cell, entries := range snapshot.Cells {
+		x.cells[h3.H3Index(cell)] = entries
+
+		for _, e := range entries {
+			x.covers[e.Region] = append(x.covers[e.Region], h3.H3Index(cell))
+		}
+	}
+
+	return x, nil
+}
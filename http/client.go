@@ -2,88 +2,315 @@ package http
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"github.com/opay-o2o/golib/breaker"
 	"github.com/opay-o2o/golib/strings2"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
+	"time"
 )
 
+const DefaultTimeout = 30 * time.Second
+
 type Client struct {
-	client *http.Client
+	client   *http.Client
+	timeout  time.Duration
+	retry    *RetryPolicy
+	breakers *breaker.Group
 }
 
-func (c *Client) Do(url string, header map[string]string, body []byte) ([]byte, error) {
-	method := strings2.IIf(body == nil, "GET", "POST")
-	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
 
-	if err != nil {
-		return nil, err
+func (r *Response) String() string {
+	return string(r.Body)
+}
+
+// build a request step by step, errors like an invalid url are reported by Do
+type Request struct {
+	client  *Client
+	ctx     context.Context
+	method  string
+	url     string
+	query   url.Values
+	header  http.Header
+	body    []byte
+	timeout time.Duration
+	accept  func(code int) bool
+	retry   *RetryPolicy
+	err     error
+}
+
+func is2xx(code int) bool {
+	return code >= 200 && code <= 299
+}
+
+func (c *Client) NewRequest(method, rawUrl string) *Request {
+	return &Request{
+		client:  c,
+		ctx:     context.Background(),
+		method:  strings2.IIf(method == "", "GET", method),
+		url:     rawUrl,
+		query:   make(url.Values, 4),
+		header:  make(http.Header, 4),
+		timeout: c.timeout,
+		accept:  is2xx,
+		retry:   c.retry,
 	}
+}
+
+func (c *Client) Get(url string) *Request {
+	return c.NewRequest("GET", url)
+}
+
+func (c *Client) Post(url string) *Request {
+	return c.NewRequest("POST", url)
+}
+
+// default timeout of the requests, 0 means none
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// default retry policy of the requests, nil disables retries
+func (c *Client) SetRetry(p *RetryPolicy) {
+	c.retry = p
+}
 
+// fail fast on hosts with consecutive network errors, 5xx or 429 responses
+func (c *Client) SetBreaker(config *breaker.Config) {
+	c.breakers = breaker.NewGroup(config)
+}
+
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r.ctx = ctx
+	return r
+}
+
+// override the timeout of the client for this request, 0 means none
+func (r *Request) Timeout(timeout time.Duration) *Request {
+	r.timeout = timeout
+	return r
+}
+
+// override the retry policy of the client for this request, nil disables retries
+func (r *Request) Retry(p *RetryPolicy) *Request {
+	r.retry = p
+	return r
+}
+
+func (r *Request) Query(key, value string) *Request {
+	r.query.Add(key, value)
+	return r
+}
+
+func (r *Request) Queries(query map[string]string) *Request {
+	for k, v := range query {
+		r.query.Add(k, v)
+	}
+
+	return r
+}
+
+func (r *Request) Header(key, value string) *Request {
+	r.header.Set(key, value)
+	return r
+}
+
+func (r *Request) Headers(header map[string]string) *Request {
 	for k, v := range header {
-		req.Header.Set(k, v)
+		r.header.Set(k, v)
 	}
 
-	resp, err := c.client.Do(req)
+	return r
+}
+
+func (r *Request) Body(body []byte) *Request {
+	r.body = body
+	return r
+}
+
+// status codes treated as success instead of any 2xx, others are returned with an error
+func (r *Request) Accept(codes ...int) *Request {
+	r.accept = func(code int) bool {
+		for _, c := range codes {
+			if c == code {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return r
+}
+
+func (r *Request) build(ctx context.Context) (*http.Request, error) {
+	u, err := url.Parse(r.url)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer func() {
-		_ = resp.Body.Close()
-	}()
+	if len(r.query) > 0 {
+		query := u.Query()
+
+		for k, values := range r.query {
+			for _, v := range values {
+				query.Add(k, v)
+			}
+		}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("error http code %d", resp.StatusCode)
+		u.RawQuery = query.Encode()
 	}
 
-	respBody, err := ioutil.ReadAll(resp.Body)
+	req, err := http.NewRequest(r.method, u.String(), bytes.NewReader(r.body))
 
 	if err != nil {
 		return nil, err
 	}
 
-	return respBody, nil
+	// the cookie jar adds to the header, so every attempt starts from a copy
+	for k, v := range r.header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+
+	return req.WithContext(ctx), nil
 }
 
-func (c *Client) DoMethod(url string, header map[string]string, body []byte, method string) ([]byte, error) {
-	method = strings2.IIf(method == "", "GET", method)
-	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+// a network error or 5xx/429 response the host is to blame for, a deadline counts
+// unless the caller canceled its own context
+func (r *Request) hostFailure(err error, code int) bool {
+	if code > 0 {
+		return code >= 500 || code == http.StatusTooManyRequests
+	}
+
+	return err != nil && r.ctx.Err() != context.Canceled
+}
+
+// send once, retry tells whether the outcome is worth another attempt
+func (r *Request) send(ctx context.Context) (response *Response, retry bool, err error) {
+	req, err := r.build(ctx)
 
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	for k, v := range header {
-		req.Header.Set(k, v)
+	var cb *breaker.Breaker
+
+	if r.client.breakers != nil {
+		if cb = r.client.breakers.Get(req.URL.Host); !cb.Allow() {
+			return nil, false, breaker.ErrOpen
+		}
 	}
 
-	resp, err := c.client.Do(req)
+	var code int
+
+	defer func() {
+		if cb == nil {
+			return
+		}
+
+		if r.hostFailure(err, code) {
+			cb.Failure()
+		} else {
+			cb.Success()
+		}
+	}()
+
+	resp, err := r.client.client.Do(req)
 
 	if err != nil {
-		return nil, err
+		return nil, ctx.Err() == nil, err
 	}
 
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("error http code %d", resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+
+	code = resp.StatusCode
+	response = &Response{StatusCode: code, Header: resp.Header, Body: body}
+	retry = code >= 500 || code == http.StatusTooManyRequests
+
+	if !r.accept(code) {
+		return response, retry, &StatusError{response}
 	}
 
-	respBody, err := ioutil.ReadAll(resp.Body)
+	return response, retry, nil
+}
+
+// send the request and read the whole body, the response is also returned with the error of an unaccepted code.
+// the timeout covers all the attempts when retries are enabled
+func (r *Request) Do() (*Response, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	ctx := r.ctx
+
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	attempts := 1
+
+	if r.retry != nil && r.retry.allowed(r.method, r.header) {
+		attempts = r.retry.attempts()
+	}
+
+	for attempt := 1; ; attempt++ {
+		response, retry, err := r.send(ctx)
+
+		if !retry || attempt >= attempts {
+			return response, err
+		}
+
+		wait, ok := r.retry.wait(ctx, attempt, response)
+
+		if !ok {
+			return response, err
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return response, err
+		}
+	}
+}
+
+func (c *Client) Do(url string, header map[string]string, body []byte) ([]byte, error) {
+	method := strings2.IIf(body == nil, "GET", "POST")
+	return c.DoMethod(url, header, body, method)
+}
+
+func (c *Client) DoMethod(url string, header map[string]string, body []byte, method string) ([]byte, error) {
+	resp, err := c.NewRequest(method, url).Headers(header).Body(body).Accept(200).Do()
 
 	if err != nil {
 		return nil, err
 	}
 
-	return respBody, nil
+	return resp.Body, nil
 }
 
 func NewClient() *Client {
 	cookie, _ := cookiejar.New(nil)
-	return &Client{client: &http.Client{Jar: cookie}}
+	return &Client{client: &http.Client{Jar: cookie}, timeout: DefaultTimeout}
 }
@@ -0,0 +1,138 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+)
+
+// a response with an unaccepted status code, the body usually holds the error payload of the upstream
+type StatusError struct {
+	*Response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error http code %d", e.StatusCode)
+}
+
+// a response body that can't be decoded into the target
+type DecodeError struct {
+	*Response
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("can't decode response | code: %d | error: %s", e.StatusCode, e.Err)
+}
+
+// decode the json body into v, like the payload of a StatusError
+func (r *Response) JSON(v interface{}) error {
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		return &DecodeError{r, err}
+	}
+
+	return nil
+}
+
+func (r *Request) JSON(v interface{}) *Request {
+	body, err := json.Marshal(v)
+
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	r.body = body
+	return r.Header("Content-Type", "application/json")
+}
+
+func (r *Request) Form(form map[string]string) *Request {
+	values := make(url.Values, len(form))
+
+	for k, v := range form {
+		values.Set(k, v)
+	}
+
+	r.body = []byte(values.Encode())
+	return r.Header("Content-Type", "application/x-www-form-urlencoded")
+}
+
+type FormFile struct {
+	Field   string
+	Name    string
+	Content io.Reader
+}
+
+// a multipart/form-data body, the files are read at once so the request can be retried
+func (r *Request) Multipart(fields map[string]string, files ...*FormFile) *Request {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			r.err = err
+			return r
+		}
+	}
+
+	for _, f := range files {
+		part, err := w.CreateFormFile(f.Field, f.Name)
+
+		if err != nil {
+			r.err = err
+			return r
+		}
+
+		if _, err := io.Copy(part, f.Content); err != nil {
+			r.err = err
+			return r
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		r.err = err
+		return r
+	}
+
+	r.body = buf.Bytes()
+	return r.Header("Content-Type", w.FormDataContentType())
+}
+
+// send the request and decode the json body of an accepted response into v, nil v skips decoding
+func (r *Request) Decode(v interface{}) (*Response, error) {
+	if r.header.Get("Accept") == "" {
+		r.Header("Accept", "application/json")
+	}
+
+	resp, err := r.Do()
+
+	if err != nil || v == nil {
+		return resp, err
+	}
+
+	return resp, resp.JSON(v)
+}
+
+func (c *Client) GetJSON(ctx context.Context, url string, query map[string]string, v interface{}) error {
+	_, err := c.Get(url).WithContext(ctx).Queries(query).Decode(v)
+	return err
+}
+
+func (c *Client) PostJSON(ctx context.Context, url string, body, v interface{}) error {
+	_, err := c.Post(url).WithContext(ctx).JSON(body).Decode(v)
+	return err
+}
+
+func (c *Client) PostForm(ctx context.Context, url string, form map[string]string, v interface{}) error {
+	_, err := c.Post(url).WithContext(ctx).Form(form).Decode(v)
+	return err
+}
+
+func (c *Client) PostMultipart(ctx context.Context, url string, fields map[string]string, files []*FormFile, v interface{}) error {
+	_, err := c.Post(url).WithContext(ctx).Multipart(fields, files...).Decode(v)
+	return err
+}
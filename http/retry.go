@@ -0,0 +1,114 @@
+package http
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// retry on network errors, 5xx and 429, backoffs are in ms and Jitter randomizes each by up to that fraction.
+// a Retry-After of the server is honored up to MaxRetryAfter ms.
+// POST and PATCH are only retried with an Idempotency-Key header unless RetryAll is set
+type RetryPolicy struct {
+	MaxAttempts    int     `toml:"max_attempts"`
+	InitialBackoff int     `toml:"initial_backoff"`
+	MaxBackoff     int     `toml:"max_backoff"`
+	Multiplier     float64 `toml:"multiplier"`
+	Jitter         float64 `toml:"jitter"`
+	MaxRetryAfter  int     `toml:"max_retry_after"`
+	RetryAll       bool    `toml:"retry_all"`
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) allowed(method string, header http.Header) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	default:
+		return p.RetryAll || header.Get(IdempotencyKeyHeader) != ""
+	}
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, maximum, multiplier := float64(p.InitialBackoff), float64(p.MaxBackoff), p.Multiplier
+
+	if initial <= 0 {
+		initial = 100
+	}
+
+	if maximum < initial {
+		maximum = initial * 10
+	}
+
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	d := math.Min(initial*math.Pow(multiplier, float64(attempt-1)), maximum)
+
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(d * float64(time.Millisecond))
+}
+
+// Retry-After in seconds or as an http date, 0 if absent
+func retryAfter(response *Response) time.Duration {
+	if response == nil {
+		return 0
+	}
+
+	value := response.Header.Get("Retry-After")
+
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+func (p *RetryPolicy) maxRetryAfter() time.Duration {
+	if p.MaxRetryAfter <= 0 {
+		return 10 * time.Second
+	}
+
+	return time.Duration(p.MaxRetryAfter) * time.Millisecond
+}
+
+// the server asking to wait takes precedence over the backoff, false when the wait ends past the deadline
+func (p *RetryPolicy) wait(ctx context.Context, attempt int, response *Response) (time.Duration, bool) {
+	d := p.backoff(attempt)
+
+	if after := retryAfter(response); after > 0 {
+		if d = after; d > p.maxRetryAfter() {
+			d = p.maxRetryAfter()
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return 0, false
+	}
+
+	return d, true
+}
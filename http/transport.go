@@ -0,0 +1,182 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/opay-o2o/golib/breaker"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"time"
+)
+
+type ClientTlsConfig struct {
+	CaPath     string `toml:"ca_path"`
+	CertPath   string `toml:"cert_path"`
+	KeyPath    string `toml:"key_path"`
+	ServerName string `toml:"server_name"`
+	SkipVerify bool   `toml:"skip_verify"`
+}
+
+// timeouts are in seconds, fields left out get the values of DefaultClientConfig,
+// an empty Proxy falls back to the HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment
+type ClientConfig struct {
+	Timeout               int              `toml:"timeout"`
+	DialTimeout           int              `toml:"dial_timeout"`
+	KeepAlive             int              `toml:"keep_alive"`
+	TlsHandshakeTimeout   int              `toml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout int              `toml:"response_header_timeout"`
+	IdleConnTimeout       int              `toml:"idle_conn_timeout"`
+	MaxIdleConns          int              `toml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int              `toml:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int              `toml:"max_conns_per_host"`
+	DisableKeepAlives     bool             `toml:"disable_keep_alives"`
+	DisableCookies        bool             `toml:"disable_cookies"`
+	Proxy                 string           `toml:"proxy"`
+	Tls                   *ClientTlsConfig `toml:"tls"`
+	Retry                 *RetryPolicy     `toml:"retry"`
+	Breaker               *breaker.Config  `toml:"breaker"`
+}
+
+func DefaultClientConfig() *ClientConfig {
+	c := &ClientConfig{}
+	c.init()
+
+	return c
+}
+
+// fields left out of the toml get the defaults, a negative Timeout disables the request timeout
+func (c *ClientConfig) init() {
+	if c.Timeout == 0 {
+		c.Timeout = int(DefaultTimeout / time.Second)
+	}
+
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = 5
+	}
+
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = 30
+	}
+
+	if c.TlsHandshakeTimeout <= 0 {
+		c.TlsHandshakeTimeout = 10
+	}
+
+	if c.IdleConnTimeout <= 0 {
+		c.IdleConnTimeout = 90
+	}
+
+	if c.MaxIdleConns <= 0 {
+		c.MaxIdleConns = 100
+	}
+
+	if c.MaxIdleConnsPerHost <= 0 {
+		c.MaxIdleConnsPerHost = 10
+	}
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+func (c *ClientTlsConfig) TlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.SkipVerify}
+
+	if c.CaPath != "" {
+		pem, err := ioutil.ReadFile(c.CaPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in " + c.CaPath)
+		}
+	}
+
+	if (c.CertPath == "") != (c.KeyPath == "") {
+		return nil, errors.New("client certificate needs both cert_path and key_path")
+	}
+
+	if c.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func (c *ClientConfig) Transport() (*http.Transport, error) {
+	c.init()
+	dialer := &net.Dialer{Timeout: seconds(c.DialTimeout), KeepAlive: seconds(c.KeepAlive)}
+
+	// a custom dialer or tls config turns http/2 off unless forced, unlike the default transport
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   seconds(c.TlsHandshakeTimeout),
+		ResponseHeaderTimeout: seconds(c.ResponseHeaderTimeout),
+		IdleConnTimeout:       seconds(c.IdleConnTimeout),
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		DisableKeepAlives:     c.DisableKeepAlives,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if c.Tls != nil {
+		config, err := c.Tls.TlsConfig()
+
+		if err != nil {
+			return nil, err
+		}
+
+		transport.TLSClientConfig = config
+	}
+
+	return transport, nil
+}
+
+func NewClientWithConfig(c *ClientConfig) (*Client, error) {
+	transport, err := c.Transport()
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{client: &http.Client{Transport: transport}, timeout: seconds(c.Timeout)}
+
+	if !c.DisableCookies {
+		client.client.Jar, _ = cookiejar.New(nil)
+	}
+
+	client.SetRetry(c.Retry)
+
+	if c.Breaker != nil {
+		client.SetBreaker(c.Breaker)
+	}
+
+	return client, nil
+}
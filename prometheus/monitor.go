@@ -30,10 +30,11 @@ var (
 )
 
 type VectorConfig struct {
-	Name   string   `toml:"name"`
-	Desc   string   `toml:"desc"`
-	Type   int      `toml:"type"`
-	Labels []string `toml:"labels"`
+	Name    string    `toml:"name"`
+	Desc    string    `toml:"desc"`
+	Type    int       `toml:"type"`
+	Labels  []string  `toml:"labels"`
+	Buckets []float64 `toml:"buckets"`
 }
 
 type Config struct {
@@ -73,18 +74,28 @@ type Monitor struct {
 	logger  *logger.Logger
 }
 
+func (m *Monitor) ConstLabels() prometheus.Labels {
+	return prometheus.Labels{"service": m.config.Service, "env": m.config.Env, "host": m.config.Host}
+}
+
 func (m *Monitor) Register(config *VectorConfig) (err error) {
 	var vec prometheus.Collector
-	constLabels := map[string]string{"service": m.config.Service, "env": m.config.Env, "host": m.config.Host}
+	constLabels := m.ConstLabels()
 
 	switch config.Type {
 	case TypeHistogram:
+		buckets := config.Buckets
+
+		if len(buckets) == 0 {
+			buckets = DefaultBuckets
+		}
+
 		vec = prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:        config.Name,
 				Help:        config.Desc,
 				ConstLabels: constLabels,
-				Buckets:     DefaultBuckets,
+				Buckets:     buckets,
 			},
 			config.Labels,
 		)
@@ -125,6 +136,10 @@ func (m *Monitor) Register(config *VectorConfig) (err error) {
 	return
 }
 
+func (m *Monitor) RegisterCollector(collector prometheus.Collector) error {
+	return prometheus.Register(collector)
+}
+
 func (m *Monitor) Trigger(name string, value float64, labels ...string) {
 	vector, ok := m.vectors[name]
 
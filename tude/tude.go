@@ -20,6 +20,14 @@ func NewPoint(lng, lat float64) *Point {
 	return &Point{lng, lat}
 }
 
+func (p *Point) Lng() float64 {
+	return p.lng
+}
+
+func (p *Point) Lat() float64 {
+	return p.lat
+}
+
 type TimePoint struct {
 	point     *Point
 	timestamp int64
@@ -29,6 +37,10 @@ func (p *TimePoint) GetPoint() *Point {
 	return p.point
 }
 
+func (p *TimePoint) GetTimestamp() int64 {
+	return p.timestamp
+}
+
 func NewTimePoint(lng, lat float64, timestamp int64) *TimePoint {
 	return &TimePoint{&Point{lng, lat}, timestamp}
 }